@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerStateClosed   BreakerState = "closed"
+	BreakerStateOpen     BreakerState = "open"
+	BreakerStateHalfOpen BreakerState = "half-open"
+)
+
+var (
+	ErrCircuitOpen = errors.New("circuit breakers of all nodes are open")
+)
+
+type (
+	BreakerState string
+	// _DialError is a failure of the node whatever isFailureFunc says, it is a plain error rather than a grpc status
+	_DialError struct {
+		err error
+	}
+	// _Breaker opens after failureThreshold failures in a row, after openTimeout it lets halfOpenCalls probe
+	// calls through, closes when all of them succeed, and opens again on the first failure
+	_Breaker struct {
+		node    *registry.Node
+		options *_BreakerOptions
+
+		mutex               sync.Mutex
+		state               BreakerState
+		generation          uint64 // changes with state, so a call started in an older state is not counted
+		consecutiveFailures int
+		openTime            time.Time
+		halfOpenCalls       int
+		halfOpenSuccesses   int
+	}
+)
+
+// withCircuitBreaker filters out the nodes whose breaker does not let a call through
+func (c *Client) withCircuitBreaker(ctx context.Context, serviceName string) (context.Context, bool) {
+	if _, ok := c.options.serviceNameMapBreakerOptions[serviceName]; !ok {
+		return ctx, false
+	}
+	return selector.WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+		breaker := c.breaker(node)
+		return breaker == nil || breaker.ready()
+	}), true
+}
+
+// breaker is nil for a node without breaker, e.g. deleted while it is selected, it never creates one,
+// breakers are created and removed only by registry events
+func (c *Client) breaker(node *registry.Node) *_Breaker {
+	c.breakerRWMutex.RLock()
+	defer c.breakerRWMutex.RUnlock()
+	return c.keyMapBreaker[node.ServiceName+"/"+node.Addr]
+}
+
+func (c *Client) createBreaker(node *registry.Node) {
+	options, ok := c.options.serviceNameMapBreakerOptions[node.ServiceName]
+	if !ok {
+		return
+	}
+	key := node.ServiceName + "/" + node.Addr
+	c.breakerRWMutex.Lock()
+	defer c.breakerRWMutex.Unlock()
+	if _, ok := c.keyMapBreaker[key]; ok { // an updated node keeps its state
+		return
+	}
+	c.keyMapBreaker[key] = &_Breaker{
+		node:    node,
+		options: options,
+		state:   BreakerStateClosed,
+	}
+}
+
+func (c *Client) removeBreaker(node *registry.Node) {
+	c.breakerRWMutex.Lock()
+	defer c.breakerRWMutex.Unlock()
+	delete(c.keyMapBreaker, node.ServiceName+"/"+node.Addr)
+}
+
+func (c *Client) onBreakerStateChange(node *registry.Node, from, to BreakerState) {
+	c.options.logInfoFunc("breakerState", "node", node, "from", from, "to", to)
+	c.options.onBreakerStateFunc(node, from, to)
+}
+
+// ready tells whether acquire would let a call through, without taking a half-open probe
+func (b *_Breaker) ready() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerStateOpen:
+		return time.Since(b.openTime) >= b.options.openTimeout
+	case BreakerStateHalfOpen:
+		return b.halfOpenCalls < b.options.halfOpenCalls
+	default:
+		return true
+	}
+}
+
+// acquire returns the doneFunc of the call, or false when the breaker does not let it through
+func (b *_Breaker) acquire(onStateChange func(node *registry.Node, from, to BreakerState)) (func(err error), bool) {
+	b.mutex.Lock()
+	from := b.state
+	if b.state == BreakerStateOpen && time.Since(b.openTime) >= b.options.openTimeout {
+		b.setState(BreakerStateHalfOpen)
+		b.halfOpenCalls, b.halfOpenSuccesses = 0, 0
+	}
+	allowed := true
+	switch b.state {
+	case BreakerStateOpen:
+		allowed = false
+	case BreakerStateHalfOpen:
+		if allowed = b.halfOpenCalls < b.options.halfOpenCalls; allowed {
+			b.halfOpenCalls++
+		}
+	}
+	to, generation := b.state, b.generation
+	b.mutex.Unlock()
+	if from != to {
+		onStateChange(b.node, from, to)
+	}
+	if !allowed {
+		return nil, false
+	}
+	return func(err error) {
+		b.done(generation, err, onStateChange)
+	}, true
+}
+
+func (b *_Breaker) done(generation uint64, err error, onStateChange func(node *registry.Node, from, to BreakerState)) {
+	b.mutex.Lock()
+	from := b.state
+	_, dialFailed := err.(*_DialError)
+	failed := dialFailed || (err != nil && b.options.isFailureFunc(err))
+	switch {
+	case generation != b.generation:
+	case !dialFailed && isNeutral(err):
+		if b.state == BreakerStateHalfOpen { // give the probe to another call
+			b.halfOpenCalls--
+		}
+	case b.state == BreakerStateClosed:
+		if !failed {
+			b.consecutiveFailures = 0
+		} else if b.consecutiveFailures++; b.consecutiveFailures >= b.options.failureThreshold {
+			b.setState(BreakerStateOpen)
+		}
+	case b.state == BreakerStateHalfOpen:
+		if failed {
+			b.setState(BreakerStateOpen)
+		} else if b.halfOpenSuccesses++; b.halfOpenSuccesses >= b.options.halfOpenCalls {
+			b.setState(BreakerStateClosed)
+		}
+	}
+	to := b.state
+	b.mutex.Unlock()
+	if from != to {
+		onStateChange(b.node, from, to)
+	}
+}
+
+func (b *_Breaker) setState(state BreakerState) {
+	b.state = state
+	b.generation++
+	switch state {
+	case BreakerStateOpen:
+		b.openTime = time.Now()
+	case BreakerStateClosed:
+		b.consecutiveFailures = 0
+	}
+}
+
+// isNeutral a call cancelled by the caller or failed by the client itself says nothing about the node
+func isNeutral(err error) bool {
+	return errors.Is(err, context.Canceled) || status.Code(err) == codes.Canceled ||
+		errors.Is(err, errNodeNotFound) || errors.Is(err, ErrClientClosed) || errors.Is(err, errConnSetClosed)
+}
+
+func (d *_DialError) Error() string {
+	return d.err.Error()
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestBreaker(opts ...BreakerOption) *_Breaker {
+	options := newOptions(WithCircuitBreaker(testServiceName, opts...))
+	return &_Breaker{
+		node:    &registry.Node{ServiceName: testServiceName, Addr: "10.0.0.10:8080"},
+		options: options.serviceNameMapBreakerOptions[testServiceName],
+		state:   BreakerStateClosed,
+	}
+}
+
+func call(t *testing.T, b *_Breaker, err error) {
+	t.Helper()
+	doneFunc, ok := b.acquire(func(node *registry.Node, from, to BreakerState) {})
+	if !ok {
+		t.Fatalf("got %v breaker rejecting the call, want it let through", b.state)
+	}
+	doneFunc(err)
+}
+
+func TestBreakerNeutralErrors(t *testing.T) {
+	b := newTestBreaker(WithBreakerFailureThreshold(2), WithBreakerOpenTimeout(time.Millisecond))
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	call(t, b, unavailable)
+	for _, err := range []error{context.Canceled, status.Error(codes.Canceled, "canceled"), errNodeNotFound, ErrClientClosed, errConnSetClosed} {
+		call(t, b, err)
+	}
+	if b.state != BreakerStateClosed || b.consecutiveFailures != 1 {
+		t.Fatalf("got %v with %v failures, want closed with 1, local errors must not reset or add failures", b.state, b.consecutiveFailures)
+	}
+	call(t, b, unavailable)
+	if b.state != BreakerStateOpen {
+		t.Fatalf("got %v, want %v", b.state, BreakerStateOpen)
+	}
+
+	time.Sleep(time.Millisecond * 2)
+	// a cancelled probe neither closes nor opens the breaker, the next call probes instead
+	call(t, b, context.Canceled)
+	if b.state != BreakerStateHalfOpen {
+		t.Fatalf("got %v, want %v", b.state, BreakerStateHalfOpen)
+	}
+	call(t, b, nil)
+	if b.state != BreakerStateClosed {
+		t.Fatalf("got %v, want %v", b.state, BreakerStateClosed)
+	}
+}
+
+func TestBreakerFollowsDiscovery(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 1, WithCircuitBreaker(testServiceName))
+	countBreakers := func() int {
+		c.breakerRWMutex.RLock()
+		defer c.breakerRWMutex.RUnlock()
+		return len(c.keyMapBreaker)
+	}
+	if got := countBreakers(); got != 1 {
+		t.Fatalf("got %v breakers, want 1 for the initial node", got)
+	}
+	node := &registry.Node{ServiceName: testServiceName, Addr: newTestServer(t)}
+	deregisterFunc, err := discoveryRegistry.Register(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the breaker of the registered node is created", func() bool {
+		return countBreakers() == 2
+	})
+	deregisterFunc()
+	waitFor(t, "the breaker of the deregistered node is removed", func() bool {
+		return countBreakers() == 1
+	})
+	for i := 0; i < 10; i++ {
+		if _, err := echo(context.Background(), c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.breaker(node) != nil || countBreakers() != 1 {
+		t.Fatalf("got %v breakers, want selecting nodes never to create one", countBreakers())
+	}
+}
@@ -8,47 +8,167 @@ import (
 	"github.com/go-productive/micro/client/selector"
 	"github.com/go-productive/micro/registry"
 	"google.golang.org/grpc"
-	"reflect"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"unsafe"
+	"time"
+)
+
+const (
+	EjectReasonOutlier     EjectReason = "outlier"
+	EjectReasonHealthCheck EjectReason = "health_check"
 )
 
 var (
+	_ grpc.ClientConnInterface = (*Client)(nil)
+
 	ErrNonstandardGRPCMethod = errors.New("nonstandard grpc method")
+	ErrClientClosed          = errors.New("client is closed")
+	errConnSetClosed         = errors.New("connections of the node are closed")
+	errNodeNotFound          = errors.New("node is not discovered")
 )
 
 type (
-	Client struct {
+	// EjectReason tells why the client took a node out of rotation, see WithOnEjectFunc
+	EjectReason string
+	Client      struct {
 		clientConn *grpc.ClientConn
 		options    *_Options
 		discovery  registry.Discovery
 
+		closed          int32
+		inflight        int64
+		watchCtx        context.Context
+		watchCancelFunc context.CancelFunc
+		loopDoneCh      chan struct{}
+
 		selectorRWMutex        sync.RWMutex
 		serviceNameMapSelector map[string]selector.Selector
 
 		connSetRWMutex sync.RWMutex
 		addrMapConnSet map[string]*_ConnSet
+
+		serviceNameMapSpillRatio sync.Map // map[string]float64
+
+		trafficPolicies atomic.Value // map[string]*selector.TrafficPolicy
+
+		breakerRWMutex sync.RWMutex
+		keyMapBreaker  map[string]*_Breaker
+
+		retryBudget *_RetryBudget
+
+		latencyTrackerRWMutex   sync.RWMutex
+		methodMapLatencyTracker map[string]*_LatencyTracker
+
+		healthCheckerRWMutex sync.RWMutex
+		keyMapHealthChecker  map[string]*_HealthChecker
+		unhealthyCount       int64
 	}
+	// _ConnSet is put in addrMapConnSet before dialing, so a slow dial never holds connSetRWMutex,
+	// connections and err are set before dialedCh is closed
 	_ConnSet struct {
 		sequence    uint64
 		connections []*grpc.ClientConn
+		err         error
+		dialedCh    chan struct{}
+
+		mutex  sync.Mutex
+		closed bool
 	}
 )
 
 func New(discovery registry.Discovery, opts ...Option) *Client {
+	options := newOptions(opts...)
+	watchCtx, watchCancelFunc := context.WithCancel(context.Background())
 	c := &Client{
-		options:                newOptions(opts...),
-		discovery:              discovery,
-		serviceNameMapSelector: make(map[string]selector.Selector),
-		addrMapConnSet:         make(map[string]*_ConnSet),
+		options:                 options,
+		discovery:               discovery,
+		watchCtx:                watchCtx,
+		watchCancelFunc:         watchCancelFunc,
+		loopDoneCh:              make(chan struct{}),
+		serviceNameMapSelector:  make(map[string]selector.Selector),
+		addrMapConnSet:          make(map[string]*_ConnSet),
+		keyMapBreaker:           make(map[string]*_Breaker),
+		methodMapLatencyTracker: make(map[string]*_LatencyTracker),
+		keyMapHealthChecker:     make(map[string]*_HealthChecker),
+		retryBudget: &_RetryBudget{
+			ratio:               options.retryBudgetRatio,
+			minRetriesPerSecond: options.minRetriesPerSecond,
+		},
 	}
 	c.initClientConn()
-	c.initServicesThenWatch()
+	if err := c.SetTrafficPolicies(c.options.trafficPolicies); err != nil {
+		panic(err)
+	}
+	if c.options.trafficConfig != nil {
+		c.watchTrafficPolicies(watchCtx, c.options.trafficConfig, c.options.trafficConfigKey)
+	}
+	c.initServicesThenWatch(watchCtx)
+	if c.options.prewarmTimeout > 0 {
+		c.prewarm(c.options.prewarmTimeout)
+	}
 	return c
 }
 
+// Close stops watching discovery, waits for in-flight calls until ctx is done or the drain timeout passes,
+// then closes all connections, which fails the calls still in flight, calls after Close fail with ErrClientClosed
+func (c *Client) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return ErrClientClosed
+	}
+	ctx, cancelFunc := context.WithTimeout(ctx, c.options.drainTimeout)
+	defer cancelFunc()
+	c.watchCancelFunc()
+	var err error
+	select {
+	case <-c.loopDoneCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = c.drain(ctx)
+	}
+	c.connSetRWMutex.Lock()
+	for addr, connSet := range c.addrMapConnSet {
+		connSet.close()
+		delete(c.addrMapConnSet, addr)
+	}
+	c.connSetRWMutex.Unlock()
+	_ = c.clientConn.Close()
+	c.options.logInfoFunc("close", "err", err)
+	return err
+}
+
+func (c *Client) drain(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&c.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// startInflight counts a call for Close to drain, the returned func ends it
+func (c *Client) startInflight() (func(), error) {
+	atomic.AddInt64(&c.inflight, 1)
+	if atomic.LoadInt32(&c.closed) != 0 {
+		atomic.AddInt64(&c.inflight, -1)
+		return nil, ErrClientClosed
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&c.inflight, -1)
+		})
+	}, nil
+}
+
 func (c *Client) ClientConn() *grpc.ClientConn {
 	return c.clientConn
 }
@@ -57,83 +177,231 @@ func (c *Client) Selector(serviceName string) selector.Selector {
 	return c.getOrCreateSelector(serviceName)
 }
 
+// initClientConn dials a grpc.ClientConn whose interceptors hand every call to the Client, it never connects,
+// its resolver produces no addresses
 func (c *Client) initClientConn() {
-	doptsField, ok := reflect.TypeOf(grpc.ClientConn{}).FieldByName("dopts")
-	if !ok {
-		panic("no dopts, compatible grpc version")
-	}
-	unaryIntField, ok := doptsField.Type.FieldByName("unaryInt")
-	if !ok {
-		panic("no dopts.unaryInt, compatible grpc version")
-	}
-	streamIntField, ok := doptsField.Type.FieldByName("streamInt")
-	if !ok {
-		panic("no dopts.streamInt, compatible grpc version")
+	clientConn, err := grpc.Dial(resolverScheme+":///micro",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(_ResolverBuilder{}),
+		grpc.WithUnaryInterceptor(c.unaryInterceptor),
+		grpc.WithStreamInterceptor(c.streamInterceptor),
+	)
+	if err != nil {
+		panic(err)
 	}
-	c.clientConn = new(grpc.ClientConn)
-	dopts := reflect.ValueOf(c.clientConn).Elem().FieldByName("dopts")
-	*(*grpc.UnaryClientInterceptor)(unsafe.Pointer(dopts.UnsafeAddr() + unaryIntField.Offset)) = c.unaryInterceptor
-	*(*grpc.StreamClientInterceptor)(unsafe.Pointer(dopts.UnsafeAddr() + streamIntField.Offset)) = c.streamInterceptor
+	c.clientConn = clientConn
 }
 
 func (c *Client) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return c.Invoke(ctx, method, req, reply, opts...)
+}
+
+func (c *Client) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return c.NewStream(ctx, desc, method, opts...)
+}
+
+// Invoke implements grpc.ClientConnInterface, so the Client itself can be passed to generated NewXxxClient
+func (c *Client) Invoke(ctx context.Context, method string, req, reply interface{}, opts ...grpc.CallOption) error {
 	if ctx == nil {
 		ctx = context.TODO()
 	}
+	endInflight, err := c.startInflight()
+	if err != nil {
+		return err
+	}
+	defer endInflight()
 	if _, ok := ctx.Deadline(); !ok {
 		var cancelFunc func()
 		ctx, cancelFunc = context.WithTimeout(ctx, micro.Timeout)
 		defer cancelFunc()
 	}
-	clientConn, err := c.selectClientConn(ctx, method)
-	if err != nil {
+	invokeFunc := func(ctx context.Context, reply interface{}) error {
+		clientConn, doneFunc, err := c.selectClientConn(ctx, method)
+		if err != nil {
+			return err
+		}
+		err = clientConn.Invoke(ctx, method, req, reply, opts...)
+		doneFunc(err)
 		return err
 	}
-	return clientConn.Invoke(ctx, method, req, reply, opts...)
+	if policy := c.hedgePolicy(method); policy != nil {
+		return c.invokeWithHedge(ctx, method, policy, reply, invokeFunc)
+	}
+	if policy := c.retryPolicy(method); policy != nil {
+		return c.invokeWithRetry(ctx, policy, func(ctx context.Context) error {
+			return invokeFunc(ctx, reply)
+		})
+	}
+	return invokeFunc(ctx, reply)
 }
 
-func (c *Client) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (stream grpc.ClientStream, e error) {
+// NewStream implements grpc.ClientConnInterface
+func (c *Client) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
 	if ctx == nil {
 		ctx = context.TODO()
 	}
-	clientConn, err := c.selectClientConn(ctx, method)
+	endInflight, err := c.startInflight()
 	if err != nil {
 		return nil, err
 	}
-	return clientConn.NewStream(ctx, desc, method, opts...)
+	clientConn, doneFunc, err := c.selectClientConn(ctx, method)
+	if err != nil {
+		endInflight()
+		return nil, err
+	}
+	clientStream, err := clientConn.NewStream(ctx, desc, method, opts...)
+	if err != nil {
+		doneFunc(err)
+		endInflight()
+		return nil, err
+	}
+	return newClientStream(ctx, clientConn, clientStream, desc, func(err error) {
+		doneFunc(err)
+		endInflight()
+	}), nil
 }
 
-func (c *Client) selectClientConn(ctx context.Context, method string) (*grpc.ClientConn, error) {
+// selectClientConn returns a doneFunc that must be called with the result of the call
+func (c *Client) selectClientConn(ctx context.Context, method string) (*grpc.ClientConn, func(err error), error) {
 	split := strings.Split(method, "/")
 	if len(split) != 3 {
-		return nil, ErrNonstandardGRPCMethod
+		return nil, nil, ErrNonstandardGRPCMethod
 	}
-	node := c.getOrCreateSelector(split[1]).Select(ctx)
-	if node == nil {
-		return nil, fmt.Errorf("service:%v not found", split[1])
+	selector := c.getOrCreateSelector(split[1])
+	healthyCtx, checking := c.withHealthCheck(ctx)
+	node, breakerDoneFunc, err := c.selectNode(healthyCtx, split[1], selector)
+	if err != nil && checking { // no healthy node, the checks may be wrong rather than all nodes, so try them all
+		node, breakerDoneFunc, err = c.selectNode(ctx, split[1], selector)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if tried, ok := ctx.Value(triedAddrs{}).(*_TriedAddrs); ok {
+		tried.add(node.Addr)
+	}
+	clientConn, err := c.getOrCreateClientConn(ctx, node.Addr)
+	if err != nil {
+		if ctx.Err() != nil || isNeutral(err) { // the call gave up waiting for the dial, or the client failed it
+			breakerDoneFunc(err)
+		} else {
+			breakerDoneFunc(&_DialError{err: err})
+		}
+		return nil, nil, err
+	}
+	doneFunc := c.startCall(selector, node)
+	return clientConn, func(err error) {
+		breakerDoneFunc(err)
+		doneFunc(err)
+	}, nil
+}
+
+func (c *Client) selectNode(ctx context.Context, serviceName string, s selector.Selector) (*registry.Node, func(err error), error) {
+	breakerCtx, breaking := c.withCircuitBreaker(ctx, serviceName)
+	for {
+		node := c.selectUntriedNode(breakerCtx, serviceName, s)
+		if node == nil && breaking && c.selectUntriedNode(ctx, serviceName, s) != nil {
+			return nil, nil, ErrCircuitOpen
+		}
+		if node == nil {
+			return nil, nil, fmt.Errorf("service:%v not found", serviceName)
+		}
+		if !breaking {
+			return node, func(err error) {}, nil
+		}
+		breaker := c.breaker(node)
+		if breaker == nil {
+			return node, func(err error) {}, nil
+		}
+		if breakerDoneFunc, ok := breaker.acquire(c.onBreakerStateChange); ok {
+			return node, breakerDoneFunc, nil
+		}
+		// the last half-open probe was taken by another call, reselect without the node
+		breakerCtx = selector.WithNodeFilterFunc(breakerCtx, func(n *registry.Node) bool {
+			return n.Addr != node.Addr
+		})
+	}
+}
+
+func (c *Client) selectSplitNode(ctx context.Context, serviceName string, s selector.Selector) *registry.Node {
+	splitCtx, splitting := c.withTrafficPolicy(ctx, serviceName)
+	node := c.selectLocalNode(splitCtx, serviceName, s)
+	if node == nil && splitting { // no node in the chosen split, e.g. v2 is not deployed yet
+		node = c.selectLocalNode(ctx, serviceName, s)
+	}
+	return node
+}
+
+func (c *Client) startCall(s selector.Selector, node *registry.Node) func(err error) {
+	feedback, ok := s.(selector.Feedback)
+	if !ok {
+		return func(err error) {}
+	}
+	feedback.OnCallStart(node)
+	start := time.Now()
+	return func(err error) {
+		feedback.OnCallDone(node, time.Since(start), err)
 	}
-	return c.getOrCreateClientConn(node.Addr)
 }
 
-func (c *Client) getOrCreateClientConn(addr string) (*grpc.ClientConn, error) {
+func (c *Client) getOrCreateClientConn(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	connSet, err := c.getOrCreateConnSet(addr)
+	if err != nil {
+		return nil, err
+	}
+	return connSet.get(ctx)
+}
+
+func (c *Client) getOrCreateConnSet(addr string) (*_ConnSet, error) {
 	c.connSetRWMutex.RLock()
 	connSet, ok := c.addrMapConnSet[addr]
 	c.connSetRWMutex.RUnlock()
 	if ok {
-		return connSet.get(), nil
+		return connSet, nil
 	}
 	c.connSetRWMutex.Lock()
-	defer c.connSetRWMutex.Unlock()
 	connSet, ok = c.addrMapConnSet[addr]
 	if ok { //double check
-		return connSet.get(), nil
+		c.connSetRWMutex.Unlock()
+		return connSet, nil
 	}
-	connSet, err := c.newConnSet(addr)
-	if err != nil {
-		return nil, err
+	if atomic.LoadInt32(&c.closed) != 0 {
+		c.connSetRWMutex.Unlock()
+		return nil, ErrClientClosed
 	}
+	// handleEvent removes a node from its selector before closing its connections under connSetRWMutex,
+	// so a node deleted by now is never dialed again, e.g. by a late warmup, leaving connections nothing closes
+	if !c.isDiscovered(addr) {
+		c.connSetRWMutex.Unlock()
+		return nil, errNodeNotFound
+	}
+	connSet = &_ConnSet{dialedCh: make(chan struct{})}
 	c.addrMapConnSet[addr] = connSet
-	return connSet.get(), nil
+	c.connSetRWMutex.Unlock()
+
+	go func() { // callers wait in get, so each can give up when its ctx is done
+		connSet.dial(addr, c.options)
+		if connSet.err != nil { // the next call dials again
+			c.connSetRWMutex.Lock()
+			if c.addrMapConnSet[addr] == connSet {
+				delete(c.addrMapConnSet, addr)
+			}
+			c.connSetRWMutex.Unlock()
+		}
+	}()
+	return connSet, nil
+}
+
+func (c *Client) isDiscovered(addr string) bool {
+	c.selectorRWMutex.RLock()
+	defer c.selectorRWMutex.RUnlock()
+	for _, s := range c.serviceNameMapSelector {
+		for _, node := range s.Nodes() {
+			if node.Addr == addr {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (c *Client) getOrCreateSelector(serviceName string) selector.Selector {
@@ -150,21 +418,41 @@ func (c *Client) getOrCreateSelector(serviceName string) selector.Selector {
 		return selector
 	}
 	selector = c.options.selectorFunc(serviceName)
+	c.setOnEjectFunc(selector)
 	c.serviceNameMapSelector[serviceName] = selector
 	return selector
 }
 
-func (c *Client) initServicesThenWatch() {
-	eventCh, serviceNameMapNodes, err := c.discovery.WatchAndGet()
+func (c *Client) setOnEjectFunc(s selector.Selector) {
+	if notifier, ok := s.(selector.Notifier); ok {
+		notifier.SetOnEjectFunc(func(node *registry.Node, ejected bool) {
+			c.onEject(node, EjectReasonOutlier, ejected)
+		})
+	}
+}
+
+func (c *Client) onEject(node *registry.Node, reason EjectReason, ejected bool) {
+	c.options.logInfoFunc("eject", "node", node, "reason", reason, "ejected", ejected)
+	c.options.onEjectFunc(node, reason, ejected)
+}
+
+func (c *Client) initServicesThenWatch(ctx context.Context) {
+	eventCh, serviceNameMapNodes, err := registry.WatchAndGet(ctx, c.discovery)
 	if err != nil {
 		panic(err)
 	}
 	for serviceName, nodes := range serviceNameMapNodes {
 		c.getOrCreateSelector(serviceName).OnInit(nodes)
+		for _, node := range nodes {
+			c.createBreaker(node)
+			go c.warmup(node.Addr)
+			c.startHealthCheck(node)
+		}
 		c.options.logInfoFunc("initServices", "serviceName", serviceName, "nodes", nodes)
 	}
 	go func() {
-		for event := range eventCh {
+		defer close(c.loopDoneCh)
+		for event := range eventCh { // closed by discovery once ctx is done
 			c.options.logInfoFunc("handleEvent", "event", event)
 			c.handleEvent(event)
 		}
@@ -173,7 +461,16 @@ func (c *Client) initServicesThenWatch() {
 
 func (c *Client) handleEvent(event *registry.Event) {
 	node := event.Node
+	if event.Type == registry.NodeEventTypeCreate || event.Type == registry.NodeEventTypeUpdate {
+		c.createBreaker(node) // before the node can be selected
+	}
 	c.getOrCreateSelector(node.ServiceName).OnEvent(event)
+	if event.Type == registry.NodeEventTypeCreate {
+		go c.warmup(node.Addr)
+	}
+	if event.Type == registry.NodeEventTypeCreate || event.Type == registry.NodeEventTypeUpdate {
+		c.startHealthCheck(node)
+	}
 	if event.Type == registry.NodeEventTypeDelete {
 		c.connSetRWMutex.Lock()
 		defer c.connSetRWMutex.Unlock()
@@ -181,36 +478,62 @@ func (c *Client) handleEvent(event *registry.Event) {
 			connSet.close()
 			delete(c.addrMapConnSet, node.Addr)
 		}
+		c.removeBreaker(node)
+		c.stopHealthCheck(node)
 	}
 	c.options.onEventFunc(event)
 }
 
-func (c *Client) newConnSet(addr string) (connSet *_ConnSet, err error) {
-	defer func() {
-		if err != nil {
-			connSet.close()
+func (c *_ConnSet) dial(addr string, options *_Options) {
+	defer close(c.dialedCh)
+	connections := make([]*grpc.ClientConn, 0, options.connSizePerAddr)
+	closeAll := func() {
+		for _, conn := range connections {
+			_ = conn.Close()
 		}
-	}()
-	connSet = &_ConnSet{
-		connections: make([]*grpc.ClientConn, 0, c.options.connSizePerAddr),
+	}
+	dialOptions := options.dialOptions
+	if !options.nonBlockingDial {
+		dialOptions = append(append([]grpc.DialOption(nil), dialOptions...), grpc.WithBlock())
 	}
 	timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
 	defer cancelFunc()
-	for i := 0; i < cap(connSet.connections); i++ {
-		conn, err := grpc.DialContext(timeout, addr, c.options.dialOptions...)
+	for i := 0; i < cap(connections); i++ {
+		conn, err := grpc.DialContext(timeout, addr, dialOptions...)
 		if err != nil {
-			return connSet, err
+			closeAll()
+			c.err = err
+			return
 		}
-		connSet.connections = append(connSet.connections, conn)
+		connections = append(connections, conn)
 	}
-	return connSet, nil
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed { // the node is gone or the client is closed while dialing
+		closeAll()
+		c.err = errConnSetClosed
+		return
+	}
+	c.connections = connections
 }
 
-func (c *_ConnSet) get() *grpc.ClientConn {
-	return c.connections[atomic.AddUint64(&c.sequence, 1)%uint64(len(c.connections))]
+// get waits for the dial in progress, the call gives up waiting when ctx is done
+func (c *_ConnSet) get(ctx context.Context) (*grpc.ClientConn, error) {
+	select {
+	case <-c.dialedCh:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.connections[atomic.AddUint64(&c.sequence, 1)%uint64(len(c.connections))], nil
 }
 
 func (c *_ConnSet) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
 	for _, conn := range c.connections {
 		_ = conn.Close()
 	}
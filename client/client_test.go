@@ -0,0 +1,388 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"github.com/go-productive/micro/registry/memory"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testServiceName = "test.Echo"
+	echoMethod      = "/test.Echo/Echo"
+	streamMethod    = "/test.Echo/Stream"
+)
+
+type (
+	// _BytesCodec passes []byte messages as is, so the test service needs no generated code,
+	// protobuf messages, e.g. of grpc.health.v1, are marshaled as usual
+	_BytesCodec struct{}
+	// _EchoServer replies its own addr, so a test knows which node a call went to, handleFunc runs first
+	// when set, so a test can make a node slow or failing
+	_EchoServer struct {
+		addr       string
+		handleFunc func(ctx context.Context) error
+	}
+	// _InflightSelector counts the calls the client reports as started and not yet done
+	_InflightSelector struct {
+		*selector.UniversalSelector
+		inflight int64
+	}
+)
+
+var (
+	echoServiceDesc = grpc.ServiceDesc{
+		ServiceName: testServiceName,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Echo",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				var req []byte
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				if handleFunc := srv.(*_EchoServer).handleFunc; handleFunc != nil {
+					if err := handleFunc(ctx); err != nil {
+						return nil, err
+					}
+				}
+				return []byte(srv.(*_EchoServer).addr), nil
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "Stream",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				var req []byte
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+				return stream.SendMsg([]byte(srv.(*_EchoServer).addr))
+			},
+		}},
+	}
+	streamDesc = &grpc.StreamDesc{StreamName: "Stream", ServerStreams: true}
+)
+
+func (_BytesCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case *[]byte:
+		return *v, nil
+	case proto.Message:
+		return proto.Marshal(v)
+	}
+	return nil, fmt.Errorf("unexpected message type %T", v)
+}
+
+func (_BytesCodec) Unmarshal(data []byte, v interface{}) error {
+	if message, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, message)
+	}
+	bs, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*bs = append([]byte(nil), data...)
+	return nil
+}
+
+func (_BytesCodec) Name() string {
+	return "bytes"
+}
+
+func (s *_InflightSelector) OnCallStart(node *registry.Node) {
+	atomic.AddInt64(&s.inflight, 1)
+}
+
+func (s *_InflightSelector) OnCallDone(node *registry.Node, latency time.Duration, err error) {
+	atomic.AddInt64(&s.inflight, -1)
+}
+
+func newTestServer(t *testing.T) string {
+	return newFuncServer(t, nil)
+}
+
+func newFuncServer(t *testing.T, handleFunc func(ctx context.Context) error) string {
+	return startTestServer(t, handleFunc, func(server *grpc.Server) {})
+}
+
+// startTestServer registerFunc registers more services, e.g. grpc.health.v1
+func startTestServer(t *testing.T, handleFunc func(ctx context.Context) error, registerFunc func(server *grpc.Server)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(_BytesCodec{}))
+	server.RegisterService(&echoServiceDesc, &_EchoServer{addr: listener.Addr().String(), handleFunc: handleFunc})
+	registerFunc(server)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// newTestClient registers serverCount servers in a memory registry, then creates a Client discovering them
+func newTestClient(t *testing.T, serverCount int, opts ...Option) (*Client, registry.Registry, []string) {
+	discoveryRegistry := memory.New()
+	var addrs []string
+	for i := 0; i < serverCount; i++ {
+		addr := newTestServer(t)
+		if _, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr}); err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+	}
+	c := New(discoveryRegistry, append([]Option{WithLogInfoFunc(func(msg string, keysAndValues ...interface{}) {})}, opts...)...)
+	t.Cleanup(func() {
+		_ = c.Close(context.Background())
+	})
+	return c, discoveryRegistry, addrs
+}
+
+// echo returns the addr of the node that served the call
+func echo(ctx context.Context, cc grpc.ClientConnInterface) (string, error) {
+	var reply []byte
+	if err := cc.Invoke(ctx, echoMethod, []byte("ping"), &reply, grpc.ForceCodec(_BytesCodec{})); err != nil {
+		return "", err
+	}
+	return string(reply), nil
+}
+
+func TestClientConnInvoke(t *testing.T) {
+	c, _, addrs := newTestClient(t, 2)
+	for _, addr := range addrs {
+		got, err := echo(selector.WithSpecifyAddr(context.Background(), addr), c.ClientConn())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != addr {
+			t.Fatalf("got %v, want %v", got, addr)
+		}
+	}
+}
+
+func TestClientInvoke(t *testing.T) {
+	c, _, addrs := newTestClient(t, 3)
+	for i := 0; i < 10; i++ {
+		ctx := selector.WithConsistHash(context.Background(), "key"+strconv.Itoa(i))
+		first, err := echo(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			if got, err := echo(ctx, c); err != nil || got != first {
+				t.Fatalf("got %v %v, want %v for the same hash key", got, err, first)
+			}
+		}
+	}
+
+	addrMapCount := make(map[string]int)
+	for i := 0; i < len(addrs)*10; i++ {
+		got, err := echo(selector.WithRoundRobin(context.Background()), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrMapCount[got]++
+	}
+	for _, addr := range addrs {
+		if addrMapCount[addr] != 10 {
+			t.Fatalf("got %v, want 10 calls per addr", addrMapCount)
+		}
+	}
+}
+
+func TestNewStream(t *testing.T) {
+	c, _, addrs := newTestClient(t, 2)
+	for _, cc := range []grpc.ClientConnInterface{c, c.ClientConn()} {
+		ctx := selector.WithSpecifyAddr(context.Background(), addrs[1])
+		stream, err := cc.NewStream(ctx, streamDesc, streamMethod, grpc.ForceCodec(_BytesCodec{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.SendMsg([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.CloseSend(); err != nil {
+			t.Fatal(err)
+		}
+		var reply []byte
+		if err := stream.RecvMsg(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != addrs[1] {
+			t.Fatalf("got %v, want %v", string(reply), addrs[1])
+		}
+		if err := stream.RecvMsg(&reply); err != io.EOF { // ends the call, so Close does not wait for it
+			t.Fatalf("got %v, want %v", err, io.EOF)
+		}
+	}
+}
+
+func TestStreamReleasesInflight(t *testing.T) {
+	inflightSelector := &_InflightSelector{UniversalSelector: new(selector.UniversalSelector)}
+	c, discoveryRegistry, _ := newTestClient(t, 1, WithSelectorFunc(func(serviceName string) selector.Selector {
+		return inflightSelector
+	}))
+	addr := newTestServer(t)
+	deregisterFunc, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	stream, err := c.NewStream(selector.WithSpecifyAddr(context.Background(), addr), streamDesc, streamMethod, grpc.ForceCodec(_BytesCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt64(&inflightSelector.inflight); got != 1 {
+		t.Fatalf("got %v, want 1 in-flight stream", got)
+	}
+	// the stream is never read to the end and its ctx never ends, deleting its node closes its connection
+	deregisterFunc()
+	waitFor(t, "the stream of the deleted node is done", func() bool {
+		return atomic.LoadInt64(&inflightSelector.inflight) == 0
+	})
+}
+
+func TestDiscoveryEvents(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 1)
+	addr := newTestServer(t)
+	deregisterFunc, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := selector.WithSpecifyAddr(context.Background(), addr)
+	waitFor(t, "the registered node is discovered", func() bool {
+		got, err := echo(ctx, c)
+		return err == nil && got == addr
+	})
+	deregisterFunc()
+	waitFor(t, "the deregistered node is removed", func() bool {
+		_, err := echo(ctx, c)
+		return err != nil
+	})
+}
+
+func TestClose(t *testing.T) {
+	c, _, _ := newTestClient(t, 1)
+	if _, err := echo(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(context.Background()); err != ErrClientClosed {
+		t.Fatalf("got %v, want %v", err, ErrClientClosed)
+	}
+	for _, cc := range []grpc.ClientConnInterface{c, c.ClientConn()} {
+		if _, err := echo(context.Background(), cc); !errors.Is(err, ErrClientClosed) {
+			t.Fatalf("got %v, want %v", err, ErrClientClosed)
+		}
+	}
+}
+
+func TestCloseDrainTimeout(t *testing.T) {
+	c, _, _ := newTestClient(t, 1, WithDrainTimeout(time.Millisecond*100))
+	stream, err := c.NewStream(context.Background(), streamDesc, streamMethod, grpc.ForceCodec(_BytesCodec{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	// the stream is never read to the end, so it stays in flight
+	start := time.Now()
+	if err := c.Close(context.Background()); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got %v, want Close to give up draining after the drain timeout", elapsed)
+	}
+}
+
+func TestNonstandardMethod(t *testing.T) {
+	c, _, _ := newTestClient(t, 1)
+	var reply []byte
+	if err := c.Invoke(context.Background(), "Echo", []byte("ping"), &reply); err != ErrNonstandardGRPCMethod {
+		t.Fatalf("got %v, want %v", err, ErrNonstandardGRPCMethod)
+	}
+}
+
+// closedAddr is an addr nothing listens on, so dials to it never get ready
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func TestDialHonorsCtx(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 1)
+	addr := closedAddr(t)
+	if _, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	// a blocking dial keeps trying for micro.Timeout, the call must not wait that long
+	ctx, cancelFunc := context.WithTimeout(selector.WithSpecifyAddr(context.Background(), addr), time.Millisecond*100)
+	defer cancelFunc()
+	start := time.Now()
+	if _, err := echo(ctx, c); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, codes.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("got %v, want the call to return once its ctx is done", elapsed)
+	}
+}
+
+func TestNonBlockingDial(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 1, WithNonBlockingDial())
+	addr := closedAddr(t)
+	if _, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	ctx, cancelFunc := context.WithTimeout(selector.WithSpecifyAddr(context.Background(), addr), time.Second*2)
+	defer cancelFunc()
+	if _, err := echo(ctx, c); status.Code(err) != codes.Unavailable {
+		t.Fatalf("got %v, want %v without waiting for the connection", err, codes.Unavailable)
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %v", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// _HealthChecker probes a node with grpc.health.v1 Check of its service name, the node turns unhealthy
+	// after unhealthyThreshold failed probes in a row, and healthy again after healthyThreshold passed ones
+	_HealthChecker struct {
+		node       atomic.Value // *registry.Node, replaced on update events
+		cancelFunc context.CancelFunc
+		unhealthy  int32
+	}
+)
+
+// startHealthCheck on an update event only refreshes the node of the checker
+func (c *Client) startHealthCheck(node *registry.Node) {
+	if c.options.healthCheck == nil {
+		return
+	}
+	key := node.ServiceName + "/" + node.Addr
+	c.healthCheckerRWMutex.Lock()
+	defer c.healthCheckerRWMutex.Unlock()
+	if checker, ok := c.keyMapHealthChecker[key]; ok {
+		checker.node.Store(node)
+		return
+	}
+	ctx, cancelFunc := context.WithCancel(c.watchCtx)
+	checker := &_HealthChecker{cancelFunc: cancelFunc}
+	checker.node.Store(node)
+	c.keyMapHealthChecker[key] = checker
+	go c.healthCheckLoop(ctx, key, checker)
+}
+
+func (c *Client) stopHealthCheck(node *registry.Node) {
+	if c.options.healthCheck == nil {
+		return
+	}
+	key := node.ServiceName + "/" + node.Addr
+	c.healthCheckerRWMutex.Lock()
+	defer c.healthCheckerRWMutex.Unlock()
+	if checker, ok := c.keyMapHealthChecker[key]; ok {
+		checker.cancelFunc()
+		if atomic.LoadInt32(&checker.unhealthy) != 0 {
+			atomic.AddInt64(&c.unhealthyCount, -1)
+		}
+		delete(c.keyMapHealthChecker, key)
+	}
+}
+
+func (c *Client) healthCheckLoop(ctx context.Context, key string, checker *_HealthChecker) {
+	options := c.options.healthCheck
+	ticker := time.NewTicker(options.interval)
+	defer ticker.Stop()
+	failures, successes := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		node := checker.node.Load().(*registry.Node)
+		err := c.checkHealth(ctx, node)
+		if ctx.Err() != nil || err == errNodeNotFound { // the node is gone, stopHealthCheck is on its way
+			return
+		}
+		if err != nil {
+			failures, successes = failures+1, 0
+		} else {
+			failures, successes = 0, successes+1
+		}
+		switch {
+		case failures >= options.unhealthyThreshold && c.setHealthy(key, checker, false):
+			c.options.logInfoFunc("healthCheck", "node", node, "err", err)
+			c.onEject(node, EjectReasonHealthCheck, true)
+		case successes >= options.healthyThreshold && c.setHealthy(key, checker, true):
+			c.onEject(node, EjectReasonHealthCheck, false)
+		}
+	}
+}
+
+// setHealthy tells whether the state of the checker changed, a stopped checker does not change
+func (c *Client) setHealthy(key string, checker *_HealthChecker, healthy bool) bool {
+	var from, to int32 = 0, 1
+	if healthy {
+		from, to = 1, 0
+	}
+	c.healthCheckerRWMutex.Lock()
+	defer c.healthCheckerRWMutex.Unlock()
+	if c.keyMapHealthChecker[key] != checker || !atomic.CompareAndSwapInt32(&checker.unhealthy, from, to) {
+		return false
+	}
+	atomic.AddInt64(&c.unhealthyCount, int64(to-from))
+	return true
+}
+
+// checkHealth a node without the health service is healthy, the registry is the only source of truth for it
+func (c *Client) checkHealth(ctx context.Context, node *registry.Node) error {
+	clientConn, err := c.getOrCreateClientConn(ctx, node.Addr) // never dials a deleted node again
+	if err != nil {
+		return err
+	}
+	timeout, cancelFunc := context.WithTimeout(ctx, c.options.healthCheck.timeout)
+	defer cancelFunc()
+	rsp, err := healthpb.NewHealthClient(clientConn).Check(timeout, &healthpb.HealthCheckRequest{Service: node.ServiceName})
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rsp.Status != healthpb.HealthCheckResponse_SERVING {
+		return status.Errorf(codes.Unavailable, "health status:%v", rsp.Status)
+	}
+	return nil
+}
+
+// withHealthCheck filters out unhealthy nodes, it does nothing while all nodes are healthy
+func (c *Client) withHealthCheck(ctx context.Context) (context.Context, bool) {
+	if atomic.LoadInt64(&c.unhealthyCount) <= 0 {
+		return ctx, false
+	}
+	return selector.WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+		c.healthCheckerRWMutex.RLock()
+		checker, ok := c.keyMapHealthChecker[node.ServiceName+"/"+node.Addr]
+		c.healthCheckerRWMutex.RUnlock()
+		return !ok || atomic.LoadInt32(&checker.unhealthy) == 0
+	}), true
+}
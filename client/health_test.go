@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type (
+	// _HealthServer answers Check with the status the test sets
+	_HealthServer struct {
+		healthpb.UnimplementedHealthServer
+		serving int32
+	}
+	// _EjectRecorder records the calls of WithOnEjectFunc
+	_EjectRecorder struct {
+		mutex   sync.Mutex
+		ejected map[string]bool
+	}
+)
+
+func (h *_HealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if atomic.LoadInt32(&h.serving) == 0 {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func (h *_HealthServer) setServing(serving bool) {
+	if serving {
+		atomic.StoreInt32(&h.serving, 1)
+	} else {
+		atomic.StoreInt32(&h.serving, 0)
+	}
+}
+
+func (e *_EjectRecorder) onEject(node *registry.Node, reason EjectReason, ejected bool) {
+	if reason != EjectReasonHealthCheck {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.ejected[node.Addr] = ejected
+}
+
+func (e *_EjectRecorder) isEjected(addr string) (bool, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ejected, ok := e.ejected[addr]
+	return ejected, ok
+}
+
+// registerHealthServer registers a test server having the health service
+func registerHealthServer(t *testing.T, c *Client, r registry.Registry) (string, *_HealthServer) {
+	healthServer := &_HealthServer{serving: 1}
+	addr := startTestServer(t, nil, func(server *grpc.Server) {
+		healthpb.RegisterHealthServer(server, healthServer)
+	})
+	if _, err := r.Register(&registry.Node{ServiceName: testServiceName, Addr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	return addr, healthServer
+}
+
+func newHealthCheckClient(t *testing.T) (*Client, registry.Registry, *_EjectRecorder) {
+	recorder := &_EjectRecorder{ejected: make(map[string]bool)}
+	c, discoveryRegistry, _ := newTestClient(t, 0,
+		WithHealthCheck(WithHealthCheckInterval(time.Millisecond*20, time.Millisecond*200), WithHealthCheckThresholds(2, 2)),
+		WithOnEjectFunc(recorder.onEject),
+	)
+	return c, discoveryRegistry, recorder
+}
+
+func TestHealthCheck(t *testing.T) {
+	c, discoveryRegistry, recorder := newHealthCheckClient(t)
+	addr, _ := registerHealthServer(t, c, discoveryRegistry)
+	sickAddr, sickServer := registerHealthServer(t, c, discoveryRegistry)
+	// a node without the health service counts as healthy
+	plainAddr := newTestServer(t)
+	if _, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: plainAddr}); err != nil {
+		t.Fatal(err)
+	}
+
+	sickServer.setServing(false)
+	waitFor(t, "the node is ejected", func() bool {
+		ejected, _ := recorder.isEjected(sickAddr)
+		return ejected
+	})
+	addrMapCount := countEchoes(t, c, 50)
+	if addrMapCount[sickAddr] != 0 || addrMapCount[addr]+addrMapCount[plainAddr] != 50 {
+		t.Fatalf("got %v, want no call to the unhealthy node", addrMapCount)
+	}
+	if _, ok := recorder.isEjected(plainAddr); ok {
+		t.Fatal("got the node without the health service ejected, want it healthy")
+	}
+
+	sickServer.setServing(true)
+	waitFor(t, "the node is healthy again", func() bool {
+		ejected, ok := recorder.isEjected(sickAddr)
+		return ok && !ejected
+	})
+	waitFor(t, "calls go to the node again", func() bool {
+		return countEchoes(t, c, 20)[sickAddr] > 0
+	})
+}
+
+func TestHealthCheckAllUnhealthy(t *testing.T) {
+	c, discoveryRegistry, recorder := newHealthCheckClient(t)
+	addr, healthServer := registerHealthServer(t, c, discoveryRegistry)
+	healthServer.setServing(false)
+	waitFor(t, "the node is ejected", func() bool {
+		ejected, _ := recorder.isEjected(addr)
+		return ejected
+	})
+	// the checks may be wrong rather than all nodes, so calls still go to them
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[addr] != 10 {
+		t.Fatalf("got %v, want all calls to the only node", addrMapCount)
+	}
+}
+
+func TestHealthCheckStops(t *testing.T) {
+	c, discoveryRegistry, recorder := newHealthCheckClient(t)
+	addr, healthServer := registerHealthServer(t, c, discoveryRegistry)
+	deregisterFunc, err := discoveryRegistry.Register(&registry.Node{ServiceName: testServiceName, Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer.setServing(false)
+	waitFor(t, "the node is ejected", func() bool {
+		ejected, _ := recorder.isEjected(addr)
+		return ejected
+	})
+	deregisterFunc()
+	waitFor(t, "the checker of the deleted node is stopped", func() bool {
+		c.healthCheckerRWMutex.RLock()
+		defer c.healthCheckerRWMutex.RUnlock()
+		return len(c.keyMapHealthChecker) == 0 && atomic.LoadInt64(&c.unhealthyCount) == 0
+	})
+}
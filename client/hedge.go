@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencySampleSize       = 1000
+	latencyMinSamples       = 100
+	latencyRecomputeSamples = 100
+)
+
+type (
+	// HedgePolicy starts another attempt of a unary call on a different node when no attempt answered within
+	// the delay, up to MaxAttempts, the first success wins and cancels the others, the delay is the Percentile
+	// of the method's latencies tracked by the client, e.g. 0.95, or Delay when Percentile is 0 or until 100
+	// calls are tracked. An attempt failing with NonFatalCodes starts the next one at once, other codes fail the call
+	HedgePolicy struct {
+		MaxAttempts   int
+		Delay         time.Duration
+		Percentile    float64
+		NonFatalCodes []codes.Code
+	}
+	// _LatencyTracker keeps the last latencySampleSize latencies of successful attempts of a method
+	_LatencyTracker struct {
+		mutex      sync.Mutex
+		samples    []time.Duration
+		next       int
+		recorded   int
+		percentile time.Duration
+	}
+	_HedgeResult struct {
+		reply interface{}
+		err   error
+	}
+)
+
+func (c *Client) hedgePolicy(method string) *HedgePolicy {
+	return c.options.methodMapHedgePolicy[method]
+}
+
+// invokeWithHedge every hedged attempt takes from the retry budget, so hedging can not multiply the load
+func (c *Client) invokeWithHedge(ctx context.Context, method string, policy *HedgePolicy, reply interface{}, invokeFunc func(ctx context.Context, reply interface{}) error) error {
+	c.retryBudget.addCall()
+	tracker := c.getOrCreateLatencyTracker(method)
+	ctx, cancelFunc := context.WithCancel(context.WithValue(ctx, triedAddrs{}, new(_TriedAddrs)))
+	defer cancelFunc()
+	resultCh := make(chan *_HedgeResult, policy.MaxAttempts)
+	started, pending := 0, 0
+	start := func() {
+		started++
+		pending++
+		attemptReply := reflect.New(reflect.TypeOf(reply).Elem()).Interface()
+		go func() {
+			begin := time.Now()
+			err := invokeFunc(ctx, attemptReply)
+			if err == nil {
+				tracker.record(time.Since(begin))
+			}
+			resultCh <- &_HedgeResult{reply: attemptReply, err: err}
+		}()
+	}
+	start()
+	var timerCh <-chan time.Time
+	delay := policy.delay(tracker)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timerCh = timer.C
+	}
+	var lastErr error
+	for {
+		select {
+		case result := <-resultCh:
+			pending--
+			if result.err == nil {
+				copyReply(reply, result.reply)
+				return nil
+			}
+			lastErr = result.err
+			if !policy.nonFatal(result.err) {
+				return result.err
+			}
+			if started < policy.MaxAttempts && ctx.Err() == nil && c.retryBudget.tryRetry() {
+				start()
+			} else if pending <= 0 {
+				return lastErr
+			}
+		case <-timerCh:
+			timerCh = nil
+			if started < policy.MaxAttempts && c.retryBudget.tryRetry() {
+				start()
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+				timerCh = timer.C
+			}
+		}
+	}
+}
+
+// copyReply a message generated before the protobuf APIv2 is copied as a struct
+func copyReply(dst, src interface{}) {
+	if dstMessage, ok := dst.(proto.Message); ok {
+		proto.Reset(dstMessage)
+		proto.Merge(dstMessage, src.(proto.Message))
+		return
+	}
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
+}
+
+func (c *Client) getOrCreateLatencyTracker(method string) *_LatencyTracker {
+	c.latencyTrackerRWMutex.RLock()
+	tracker, ok := c.methodMapLatencyTracker[method]
+	c.latencyTrackerRWMutex.RUnlock()
+	if ok {
+		return tracker
+	}
+	c.latencyTrackerRWMutex.Lock()
+	defer c.latencyTrackerRWMutex.Unlock()
+	tracker, ok = c.methodMapLatencyTracker[method]
+	if ok { //double check
+		return tracker
+	}
+	tracker = &_LatencyTracker{samples: make([]time.Duration, latencySampleSize)}
+	c.methodMapLatencyTracker[method] = tracker
+	return tracker
+}
+
+func (p *HedgePolicy) delay(tracker *_LatencyTracker) time.Duration {
+	if p.Percentile > 0 {
+		if percentile := tracker.get(p.Percentile); percentile > 0 {
+			return percentile
+		}
+	}
+	return p.Delay
+}
+
+func (p *HedgePolicy) nonFatal(err error) bool {
+	code := status.Code(err)
+	for _, nonFatalCode := range p.NonFatalCodes {
+		if code == nonFatalCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *HedgePolicy) withDefaults() *HedgePolicy {
+	cp := *p
+	if cp.MaxAttempts <= 0 {
+		cp.MaxAttempts = 2
+	}
+	if len(cp.NonFatalCodes) <= 0 {
+		cp.NonFatalCodes = []codes.Code{codes.Unavailable}
+	}
+	return &cp
+}
+
+func (t *_LatencyTracker) record(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.samples[t.next] = latency
+	t.next = (t.next + 1) % len(t.samples)
+	if t.recorded++; t.recorded%latencyRecomputeSamples == 0 {
+		t.percentile = 0 // recomputed lazily by get
+	}
+}
+
+// get returns 0 until latencyMinSamples are recorded, the percentile is sorted again every latencyRecomputeSamples
+func (t *_LatencyTracker) get(percentile float64) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.recorded < latencyMinSamples {
+		return 0
+	}
+	if t.percentile <= 0 {
+		n := t.recorded
+		if n > len(t.samples) {
+			n = len(t.samples)
+		}
+		sorted := append([]time.Duration(nil), t.samples[:n]...)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i] < sorted[j]
+		})
+		index := int(percentile * float64(n))
+		if index >= n {
+			index = n - 1
+		}
+		t.percentile = sorted[index]
+	}
+	return t.percentile
+}
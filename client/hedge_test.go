@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sleepFor replies after d, or fails once the call is cancelled, e.g. by a winning hedged attempt
+func sleepFor(d time.Duration, cancelled *int64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-ctx.Done():
+			atomic.AddInt64(cancelled, 1)
+			return ctx.Err()
+		}
+	}
+}
+
+func TestHedge(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithHedgePolicy(echoMethod, &HedgePolicy{Delay: time.Millisecond * 20}))
+	cancelled := new(int64)
+	_, slowCalls := registerFuncServer(t, c, discoveryRegistry, sleepFor(time.Second, cancelled))
+	fastAddr, _ := registerFuncServer(t, c, discoveryRegistry, nil)
+	for i := 0; i < 20; i++ {
+		start := time.Now()
+		if addr, err := echo(context.Background(), c); err != nil || addr != fastAddr {
+			t.Fatalf("got %v %v, want the reply of %v", addr, err, fastAddr)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+			t.Fatalf("got %v, want the hedged attempt to answer first", elapsed)
+		}
+	}
+	waitFor(t, "the slow attempts are cancelled", func() bool {
+		return atomic.LoadInt64(cancelled) == atomic.LoadInt64(slowCalls)
+	})
+}
+
+func TestHedgeCodes(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithHedgePolicy(echoMethod, &HedgePolicy{Delay: time.Second}))
+	registerFuncServer(t, c, discoveryRegistry, failWith(codes.Unavailable))
+	addr, _ := registerFuncServer(t, c, discoveryRegistry, nil)
+	// a non-fatal failure starts the next attempt at once, without waiting for the delay
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		if got, err := echo(context.Background(), c); err != nil || got != addr {
+			t.Fatalf("got %v %v, want the reply of %v", got, err, addr)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+			t.Fatalf("got %v, want no wait for the delay", elapsed)
+		}
+	}
+
+	c, discoveryRegistry, _ = newTestClient(t, 0, WithHedgePolicy(echoMethod, &HedgePolicy{Delay: time.Second}))
+	_, failedCalls := registerFuncServer(t, c, discoveryRegistry, failWith(codes.InvalidArgument))
+	registerFuncServer(t, c, discoveryRegistry, failWith(codes.InvalidArgument))
+	if _, err := echo(context.Background(), c); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("got %v, want %v", err, codes.InvalidArgument)
+	}
+	if calls := atomic.LoadInt64(failedCalls); calls > 1 {
+		t.Fatalf("got %v calls, want a fatal code to end the call", calls)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		opts         []Option
+		wantAttempts int64
+	}{
+		{"hedged", nil, 2},
+		{"no budget", []Option{WithRetryBudget(0, 0)}, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opts := append([]Option{WithHedgePolicy(echoMethod, &HedgePolicy{Delay: time.Millisecond * 10})}, c.opts...)
+			client, discoveryRegistry, _ := newTestClient(t, 0, opts...)
+			_, calls := registerFuncServer(t, client, discoveryRegistry, sleepFor(time.Millisecond*100, new(int64)))
+			if _, err := echo(context.Background(), client); err != nil {
+				t.Fatal(err)
+			}
+			if attempts := atomic.LoadInt64(calls); attempts != c.wantAttempts {
+				t.Fatalf("got %v attempts, want %v", attempts, c.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := &_LatencyTracker{samples: make([]time.Duration, latencySampleSize)}
+	for i := 1; i < latencyMinSamples; i++ {
+		tracker.record(time.Duration(i) * time.Millisecond)
+	}
+	if percentile := tracker.get(0.95); percentile != 0 {
+		t.Fatalf("got %v, want 0 before %v samples", percentile, latencyMinSamples)
+	}
+	tracker.record(latencyMinSamples * time.Millisecond)
+	if percentile := tracker.get(0.95); percentile != time.Millisecond*96 {
+		t.Fatalf("got %v, want 96ms", percentile)
+	}
+	policy := (&HedgePolicy{Delay: time.Second, Percentile: 0.95}).withDefaults()
+	if delay := policy.delay(tracker); delay != time.Millisecond*96 {
+		t.Fatalf("got %v, want the percentile over Delay once there are enough samples", delay)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/connectivity"
+	"math"
+	"math/rand"
+)
+
+// selectLocalNode falls back to all zones when no node in the chosen zones can take the call,
+// e.g. all local nodes are unhealthy or their breakers are open
+func (c *Client) selectLocalNode(ctx context.Context, serviceName string, s selector.Selector) *registry.Node {
+	localCtx, localizing := c.withLocality(ctx, serviceName, s)
+	node := c.selectReadyNode(localCtx, s)
+	if node == nil && localizing {
+		node = c.selectReadyNode(ctx, s)
+	}
+	return node
+}
+
+// withLocality routes to the nodes of the caller's zone, the local share of a service is 1 when its local
+// capacity (sum of weights of the usable nodes) is an even share of all zones, below zoneSpillThreshold
+// a proportional part of the calls spills to other zones, and all of them do when the local zone has no usable node
+func (c *Client) withLocality(ctx context.Context, serviceName string, s selector.Selector) (context.Context, bool) {
+	if c.options.zone == "" || selector.IsSpecifyAddr(ctx) {
+		return ctx, false
+	}
+	localWeight, totalWeight := 0, 0
+	zones := make(map[string]struct{})
+	for _, node := range selector.Candidates(ctx, s) {
+		if c.isDown(node) {
+			continue
+		}
+		zone := node.Meta().Zone
+		zones[zone] = struct{}{}
+		totalWeight += node.Weight()
+		if zone == c.options.zone {
+			localWeight += node.Weight()
+		}
+	}
+	if totalWeight <= 0 {
+		return ctx, false
+	}
+	localShare := float64(localWeight) * float64(len(zones)) / float64(totalWeight)
+	var spillRatio float64
+	switch {
+	case localWeight <= 0:
+		spillRatio = 1
+	case c.options.zoneSpillThreshold > 0:
+		spillRatio = math.Max(0, 1-localShare/c.options.zoneSpillThreshold)
+	}
+	c.logLocality(serviceName, localShare, spillRatio)
+	if spillRatio > 0 && rand.Float64() < spillRatio {
+		return selector.WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+			return node.Meta().Zone != c.options.zone
+		}), true
+	}
+	return selector.WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+		return node.Meta().Zone == c.options.zone
+	}), true
+}
+
+// isDown tells whether the connections of the node are known to be broken, a node not dialed yet is not
+func (c *Client) isDown(node *registry.Node) bool {
+	c.connSetRWMutex.RLock()
+	connSet, ok := c.addrMapConnSet[node.Addr]
+	c.connSetRWMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	select {
+	case <-connSet.dialedCh:
+	default:
+		return false
+	}
+	if connSet.err != nil {
+		return true
+	}
+	for _, conn := range connSet.connections {
+		if state := conn.GetState(); state != connectivity.TransientFailure && state != connectivity.Shutdown {
+			return false
+		}
+	}
+	return true
+}
+
+// logLocality logs only when the routing decision of the service changes, concurrent calls may log a change twice
+func (c *Client) logLocality(serviceName string, localShare, spillRatio float64) {
+	spillRatio = math.Round(spillRatio*100) / 100
+	if lastSpillRatio, ok := c.serviceNameMapSpillRatio.Load(serviceName); ok && lastSpillRatio.(float64) == spillRatio {
+		return
+	}
+	c.serviceNameMapSpillRatio.Store(serviceName, spillRatio)
+	c.options.logInfoFunc("locality", "serviceName", serviceName, "zone", c.options.zone, "localShare", localShare, "spillRatio", spillRatio)
+}
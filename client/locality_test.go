@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-productive/micro/registry"
+)
+
+// registerZoneNode registers a node of zone at addr, an empty addr starts a test server
+func registerZoneNode(t *testing.T, c *Client, r registry.Registry, zone, addr string) string {
+	if addr == "" {
+		addr = newTestServer(t)
+	}
+	metadata := registry.EncodeMetadata(&registry.Metadata{Zone: zone})
+	if _, err := r.Register(&registry.Node{ServiceName: testServiceName, Addr: addr, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	return addr
+}
+
+func countEchoes(t *testing.T, c *Client, n int) map[string]int {
+	t.Helper()
+	addrMapCount := make(map[string]int)
+	for i := 0; i < n; i++ {
+		addr, err := echo(context.Background(), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrMapCount[addr]++
+	}
+	return addrMapCount
+}
+
+func TestLocality(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithZone("a"))
+	localAddr := registerZoneNode(t, c, discoveryRegistry, "a", "")
+	registerZoneNode(t, c, discoveryRegistry, "b", "")
+	if addrMapCount := countEchoes(t, c, 100); addrMapCount[localAddr] != 100 {
+		t.Fatalf("got %v, want all calls in the zone with an even share", addrMapCount)
+	}
+}
+
+func TestLocalitySpill(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithZone("a"))
+	localAddr := registerZoneNode(t, c, discoveryRegistry, "a", "")
+	for i := 0; i < 3; i++ {
+		registerZoneNode(t, c, discoveryRegistry, "b", "")
+	}
+	// the local share is 0.5, below the threshold of 0.7, so 1-0.5/0.7 of the calls spill
+	addrMapCount := countEchoes(t, c, 1000)
+	if spill := float64(1000-addrMapCount[localAddr]) / 1000; spill < 0.22 || spill > 0.36 {
+		t.Fatalf("got %v of the calls spilled, want about 0.29", spill)
+	}
+}
+
+func TestLocalityFailover(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithZone("a"), WithNonBlockingDial())
+	remoteAddr := registerZoneNode(t, c, discoveryRegistry, "b", "")
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[remoteAddr] != 10 {
+		t.Fatalf("got %v, want all calls to other zones when the zone has no node", addrMapCount)
+	}
+
+	localAddr := registerZoneNode(t, c, discoveryRegistry, "a", closedAddr(t))
+	waitFor(t, "the local node is known to be down", func() bool {
+		for _, node := range c.Selector(testServiceName).Nodes() {
+			if node.Addr == localAddr {
+				return c.isDown(node)
+			}
+		}
+		return false
+	})
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[remoteAddr] != 10 {
+		t.Fatalf("got %v, want all calls to other zones when the local nodes are down", addrMapCount)
+	}
+}
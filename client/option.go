@@ -1,23 +1,58 @@
 package client
 
 import (
+	"github.com/go-productive/micro"
 	"github.com/go-productive/micro/client/selector"
 	"github.com/go-productive/micro/registry"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 	"log"
 	"runtime"
+	"time"
 )
 
 type (
 	_Options struct {
-		selectorFunc    func(serviceName string) selector.Selector
-		dialOptions     []grpc.DialOption
-		connSizePerAddr int // latency is slow when high load if only one grpc conn
-		onEventFunc     func(event *registry.Event)
-		logInfoFunc     func(msg string, keysAndValues ...interface{})
+		selectorFunc       func(serviceName string) selector.Selector
+		dialOptions        []grpc.DialOption
+		connSizePerAddr    int // latency is slow when high load if only one grpc conn
+		nonBlockingDial    bool
+		prewarmTimeout     time.Duration
+		drainTimeout       time.Duration
+		zone               string
+		zoneSpillThreshold float64
+		trafficPolicies    map[string]*selector.TrafficPolicy
+		trafficConfig      registry.Config
+		trafficConfigKey   string
+		onEventFunc        func(event *registry.Event)
+		onEjectFunc        func(node *registry.Node, reason EjectReason, ejected bool)
+		logInfoFunc        func(msg string, keysAndValues ...interface{})
+
+		serviceNameMapBreakerOptions map[string]*_BreakerOptions
+		onBreakerStateFunc           func(node *registry.Node, from, to BreakerState)
+		nameMapRetryPolicy           map[string]*RetryPolicy
+		retryBudgetRatio             float64
+		minRetriesPerSecond          int
+		methodMapHedgePolicy         map[string]*HedgePolicy
+		healthCheck                  *_HealthCheckOptions
+	}
+	Option          func(*_Options)
+	_BreakerOptions struct {
+		failureThreshold int
+		openTimeout      time.Duration
+		halfOpenCalls    int
+		isFailureFunc    func(err error) bool
+	}
+	BreakerOption       func(*_BreakerOptions)
+	_HealthCheckOptions struct {
+		interval           time.Duration
+		timeout            time.Duration
+		unhealthyThreshold int
+		healthyThreshold   int
 	}
-	Option func(*_Options)
+	HealthCheckOption func(*_HealthCheckOptions)
 )
 
 func newOptions(opts ...Option) *_Options {
@@ -27,10 +62,15 @@ func newOptions(opts ...Option) *_Options {
 		},
 		dialOptions: []grpc.DialOption{
 			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock(),
 		},
-		connSizePerAddr: runtime.GOMAXPROCS(0),
-		onEventFunc:     func(event *registry.Event) {},
+		connSizePerAddr:     runtime.GOMAXPROCS(0),
+		drainTimeout:        micro.Timeout,
+		retryBudgetRatio:    0.2,
+		minRetriesPerSecond: 10,
+		zoneSpillThreshold:  0.7,
+		onEventFunc:         func(event *registry.Event) {},
+		onEjectFunc:         func(node *registry.Node, reason EjectReason, ejected bool) {},
+		onBreakerStateFunc:  func(node *registry.Node, from, to BreakerState) {},
 		logInfoFunc: func(msg string, keysAndValues ...interface{}) {
 			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
 		},
@@ -59,14 +99,215 @@ func WithConnSizePerAddr(connSizePerAddr int) Option {
 	}
 }
 
+// WithNonBlockingDial dials without grpc.WithBlock, a dial then returns before the connection is ready,
+// and the first calls to a node may fail while it connects
+func WithNonBlockingDial() Option {
+	return func(o *_Options) {
+		o.nonBlockingDial = true
+	}
+}
+
+// WithPrewarm makes New dial all known nodes and wait up to timeout for their connections to be ready,
+// otherwise nodes are dialed in the background when discovered or first selected
+func WithPrewarm(timeout time.Duration) Option {
+	return func(o *_Options) {
+		o.prewarmTimeout = timeout
+	}
+}
+
+// WithDrainTimeout bounds how long Close waits for in-flight calls, e.g. a stream the caller never finishes,
+// before it closes the connections under them, micro.Timeout by default, the ctx of Close may end it earlier
+func WithDrainTimeout(drainTimeout time.Duration) Option {
+	return func(o *_Options) {
+		o.drainTimeout = drainTimeout
+	}
+}
+
+// WithZone makes calls prefer nodes registered with the same zone, see server.WithZone
+func WithZone(zone string) Option {
+	return func(o *_Options) {
+		o.zone = zone
+	}
+}
+
+// WithZoneSpillThreshold is the local share below which calls start spilling to other zones, see WithZone
+func WithZoneSpillThreshold(zoneSpillThreshold float64) Option {
+	return func(o *_Options) {
+		o.zoneSpillThreshold = zoneSpillThreshold
+	}
+}
+
+// WithTrafficPolicy splits the calls of serviceName, e.g. a canary release, see Client.SetTrafficPolicies to change it at runtime
+func WithTrafficPolicy(serviceName string, policy *selector.TrafficPolicy) Option {
+	return func(o *_Options) {
+		if o.trafficPolicies == nil {
+			o.trafficPolicies = make(map[string]*selector.TrafficPolicy)
+		}
+		o.trafficPolicies[serviceName] = policy
+	}
+}
+
+// WithTrafficPolicyConfig reads the policies of all services from the key of config, the value is the json of
+// map[serviceName]*selector.TrafficPolicy, e.g. {"echo.Echo":{"splits":[{"label_selector":"version=v1","weight":95},
+// {"label_selector":"version=v2","weight":5}]}}, it overrides WithTrafficPolicy whenever the key changes
+func WithTrafficPolicyConfig(config registry.Config, key string) Option {
+	return func(o *_Options) {
+		o.trafficConfig = config
+		o.trafficConfigKey = key
+	}
+}
+
+// WithRetryPolicy retries unary calls of name, name is a service, e.g. echo.Echo, or a full method name,
+// e.g. /echo.Echo/Echo, which takes priority, zero fields of policy take the defaults: 3 attempts on
+// Unavailable, backoff from 50ms doubling up to 1s, every retry prefers a node not tried by the call
+func WithRetryPolicy(name string, policy *RetryPolicy) Option {
+	return func(o *_Options) {
+		if o.nameMapRetryPolicy == nil {
+			o.nameMapRetryPolicy = make(map[string]*RetryPolicy)
+		}
+		o.nameMapRetryPolicy[name] = policy.withDefaults()
+	}
+}
+
+// WithHedgePolicy hedges unary calls of the full method name, e.g. /echo.Echo/Echo, it takes priority over
+// WithRetryPolicy, zero fields of policy take the defaults: 2 attempts, Unavailable is non-fatal
+func WithHedgePolicy(method string, policy *HedgePolicy) Option {
+	return func(o *_Options) {
+		if o.methodMapHedgePolicy == nil {
+			o.methodMapHedgePolicy = make(map[string]*HedgePolicy)
+		}
+		o.methodMapHedgePolicy[method] = policy.withDefaults()
+	}
+}
+
+// WithRetryBudget bounds retries and hedged attempts of the client to ratio of its calls in the last 10s plus
+// minRetriesPerSecond, 0.2 and 10 by default
+func WithRetryBudget(ratio float64, minRetriesPerSecond int) Option {
+	return func(o *_Options) {
+		o.retryBudgetRatio = ratio
+		o.minRetriesPerSecond = minRetriesPerSecond
+	}
+}
+
 func WithOnEventFunc(onEventFunc func(event *registry.Event)) Option {
 	return func(o *_Options) {
 		o.onEventFunc = onEventFunc
 	}
 }
 
+// WithOnEjectFunc is called when outlier detection or health checking takes a node out of rotation and puts it back,
+// unlike WithOnEventFunc, the node stays discovered
+func WithOnEjectFunc(onEjectFunc func(node *registry.Node, reason EjectReason, ejected bool)) Option {
+	return func(o *_Options) {
+		o.onEjectFunc = onEjectFunc
+	}
+}
+
 func WithLogInfoFunc(logInfoFunc func(msg string, keysAndValues ...interface{})) Option {
 	return func(o *_Options) {
 		o.logInfoFunc = logInfoFunc
 	}
 }
+
+// WithCircuitBreaker gives every node of serviceName a circuit breaker, calls go to other nodes while a breaker
+// is open, and fail with ErrCircuitOpen when all of them are, by default it opens after 5 consecutive
+// Unavailable or DeadlineExceeded, and lets 1 probe call through after 10s
+func WithCircuitBreaker(serviceName string, opts ...BreakerOption) Option {
+	return func(o *_Options) {
+		breakerOptions := &_BreakerOptions{
+			failureThreshold: 5,
+			openTimeout:      time.Second * 10,
+			halfOpenCalls:    1,
+			isFailureFunc: func(err error) bool {
+				switch status.Code(err) {
+				case codes.Unavailable, codes.DeadlineExceeded:
+					return true
+				default:
+					return false
+				}
+			},
+		}
+		for _, opt := range opts {
+			opt(breakerOptions)
+		}
+		if o.serviceNameMapBreakerOptions == nil {
+			o.serviceNameMapBreakerOptions = make(map[string]*_BreakerOptions)
+		}
+		o.serviceNameMapBreakerOptions[serviceName] = breakerOptions
+	}
+}
+
+// WithOnBreakerStateFunc is called on every state change of a circuit breaker, e.g. to export metrics
+func WithOnBreakerStateFunc(onBreakerStateFunc func(node *registry.Node, from, to BreakerState)) Option {
+	return func(o *_Options) {
+		o.onBreakerStateFunc = onBreakerStateFunc
+	}
+}
+
+func WithBreakerFailureThreshold(failureThreshold int) BreakerOption {
+	return func(o *_BreakerOptions) {
+		o.failureThreshold = failureThreshold
+	}
+}
+
+// WithBreakerOpenTimeout is how long a breaker stays open before letting probe calls through
+func WithBreakerOpenTimeout(openTimeout time.Duration) BreakerOption {
+	return func(o *_BreakerOptions) {
+		o.openTimeout = openTimeout
+	}
+}
+
+// WithBreakerHalfOpenCalls is how many probe calls a half-open breaker lets through, all of them must succeed to close it
+func WithBreakerHalfOpenCalls(halfOpenCalls int) BreakerOption {
+	return func(o *_BreakerOptions) {
+		o.halfOpenCalls = halfOpenCalls
+	}
+}
+
+func WithBreakerIsFailureFunc(isFailureFunc func(err error) bool) BreakerOption {
+	return func(o *_BreakerOptions) {
+		o.isFailureFunc = isFailureFunc
+	}
+}
+
+// WithHealthCheck probes every discovered node with grpc.health.v1 Check of its service name, unhealthy nodes
+// are not selected unless all nodes are, a node without the health service counts as healthy, by default
+// it probes every 5s with 1s timeout, 3 failures make a node unhealthy and 2 successes healthy again,
+// the changes are reported to WithOnEjectFunc
+func WithHealthCheck(opts ...HealthCheckOption) Option {
+	return func(o *_Options) {
+		o.healthCheck = &_HealthCheckOptions{
+			interval:           time.Second * 5,
+			timeout:            time.Second,
+			unhealthyThreshold: 3,
+			healthyThreshold:   2,
+		}
+		for _, opt := range opts {
+			opt(o.healthCheck)
+		}
+	}
+}
+
+// WithHealthCheckInterval a non-positive value keeps its default
+func WithHealthCheckInterval(interval, timeout time.Duration) HealthCheckOption {
+	return func(o *_HealthCheckOptions) {
+		if interval > 0 {
+			o.interval = interval
+		}
+		if timeout > 0 {
+			o.timeout = timeout
+		}
+	}
+}
+
+// WithHealthCheckThresholds a non-positive value keeps its default
+func WithHealthCheckThresholds(unhealthyThreshold, healthyThreshold int) HealthCheckOption {
+	return func(o *_HealthCheckOptions) {
+		if unhealthyThreshold > 0 {
+			o.unhealthyThreshold = unhealthyThreshold
+		}
+		if healthyThreshold > 0 {
+			o.healthyThreshold = healthyThreshold
+		}
+	}
+}
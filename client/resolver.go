@@ -0,0 +1,28 @@
+package client
+
+import (
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	resolverScheme = "micro"
+)
+
+type (
+	// _ResolverBuilder builds resolvers that never update the state, the grpc.ClientConn of a Client stays idle,
+	// discovery and selection of nodes happen in the Client's interceptors
+	_ResolverBuilder struct{}
+	_Resolver        struct{}
+)
+
+func (_ResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	return _Resolver{}, nil
+}
+
+func (_ResolverBuilder) Scheme() string {
+	return resolverScheme
+}
+
+func (_Resolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (_Resolver) Close() {}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	retryBudgetWindow = 10 // seconds
+)
+
+type (
+	// RetryPolicy retries unary calls that fail with RetryableCodes, up to MaxAttempts including the first one,
+	// the n-th retry waits a random time below min(InitialBackoff*BackoffMultiplier^(n-1), MaxBackoff)
+	RetryPolicy struct {
+		MaxAttempts       int
+		RetryableCodes    []codes.Code
+		InitialBackoff    time.Duration
+		MaxBackoff        time.Duration
+		BackoffMultiplier float64
+	}
+	// _RetryBudget allows retries of up to ratio of the calls plus minRetriesPerSecond in a sliding window,
+	// so retries can not multiply the load of a struggling service
+	_RetryBudget struct {
+		ratio               float64
+		minRetriesPerSecond int
+
+		mutex   sync.Mutex
+		buckets [retryBudgetWindow]_RetryBucket
+	}
+	_RetryBucket struct {
+		second  int64
+		calls   int
+		retries int
+	}
+	// _TriedAddrs are the nodes the attempts of a call went to, hedged attempts run concurrently
+	_TriedAddrs struct {
+		mutex sync.Mutex
+		addrs map[string]struct{}
+	}
+	triedAddrs struct{}
+)
+
+// retryPolicy a policy of the full method name takes priority over the one of its service
+func (c *Client) retryPolicy(method string) *RetryPolicy {
+	if policy, ok := c.options.nameMapRetryPolicy[method]; ok {
+		return policy
+	}
+	split := strings.Split(method, "/")
+	if len(split) != 3 {
+		return nil
+	}
+	return c.options.nameMapRetryPolicy[split[1]]
+}
+
+func (c *Client) invokeWithRetry(ctx context.Context, policy *RetryPolicy, invokeFunc func(ctx context.Context) error) error {
+	c.retryBudget.addCall()
+	ctx = context.WithValue(ctx, triedAddrs{}, new(_TriedAddrs))
+	for attempt := 1; ; attempt++ {
+		err := invokeFunc(ctx)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		if !c.retryBudget.tryRetry() {
+			return err
+		}
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// selectUntriedNode prefers nodes that earlier attempts of the call did not go to
+func (c *Client) selectUntriedNode(ctx context.Context, serviceName string, s selector.Selector) *registry.Node {
+	if tried, ok := ctx.Value(triedAddrs{}).(*_TriedAddrs); ok && tried.len() > 0 && !selector.IsSpecifyAddr(ctx) {
+		untriedCtx := selector.WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+			return !tried.contains(node.Addr)
+		})
+		if node := c.selectSplitNode(untriedCtx, serviceName, s); node != nil {
+			return node
+		}
+	}
+	return c.selectSplitNode(ctx, serviceName, s)
+}
+
+func (t *_TriedAddrs) add(addr string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.addrs == nil {
+		t.addrs = make(map[string]struct{})
+	}
+	t.addrs[addr] = struct{}{}
+}
+
+func (t *_TriedAddrs) contains(addr string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.addrs[addr]
+	return ok
+}
+
+func (t *_TriedAddrs) len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.addrs)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	code := status.Code(err)
+	for _, retryableCode := range p.RetryableCodes {
+		if code == retryableCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.BackoffMultiplier, float64(retry-1))
+	if backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1)) // full jitter
+}
+
+func (p *RetryPolicy) withDefaults() *RetryPolicy {
+	cp := *p
+	if cp.MaxAttempts <= 0 {
+		cp.MaxAttempts = 3
+	}
+	if len(cp.RetryableCodes) <= 0 {
+		cp.RetryableCodes = []codes.Code{codes.Unavailable}
+	}
+	if cp.InitialBackoff <= 0 {
+		cp.InitialBackoff = time.Millisecond * 50
+	}
+	if cp.MaxBackoff <= 0 {
+		cp.MaxBackoff = time.Second
+	}
+	if cp.BackoffMultiplier <= 0 {
+		cp.BackoffMultiplier = 2
+	}
+	return &cp
+}
+
+func (b *_RetryBudget) bucket() *_RetryBucket {
+	second := time.Now().Unix()
+	bucket := &b.buckets[second%retryBudgetWindow]
+	if bucket.second != second {
+		*bucket = _RetryBucket{second: second}
+	}
+	return bucket
+}
+
+func (b *_RetryBudget) addCall() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bucket().calls++
+}
+
+func (b *_RetryBudget) tryRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	bucket := b.bucket()
+	minSecond := bucket.second - retryBudgetWindow
+	calls, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.second > minSecond {
+			calls, retries = calls+bucket.calls, retries+bucket.retries
+		}
+	}
+	if float64(retries) >= b.ratio*float64(calls)+float64(b.minRetriesPerSecond*retryBudgetWindow) {
+		return false
+	}
+	bucket.retries++
+	return true
+}
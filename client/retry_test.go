@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// registerFuncServer registers a test server running handleFunc, the returned counter is its calls
+func registerFuncServer(t *testing.T, c *Client, r registry.Registry, handleFunc func(ctx context.Context) error) (string, *int64) {
+	calls := new(int64)
+	addr := newFuncServer(t, func(ctx context.Context) error {
+		atomic.AddInt64(calls, 1)
+		if handleFunc == nil {
+			return nil
+		}
+		return handleFunc(ctx)
+	})
+	if _, err := r.Register(&registry.Node{ServiceName: testServiceName, Addr: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	return addr, calls
+}
+
+func failWith(code codes.Code) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return status.Error(code, code.String())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond}))
+	_, failedCalls := registerFuncServer(t, c, discoveryRegistry, failWith(codes.Unavailable))
+	addr, calls := registerFuncServer(t, c, discoveryRegistry, nil)
+	// a retry goes to the node the call has not tried
+	if addrMapCount := countEchoes(t, c, 50); addrMapCount[addr] != 50 {
+		t.Fatalf("got %v, want all calls to succeed on %v", addrMapCount, addr)
+	}
+	if got := atomic.LoadInt64(failedCalls) + atomic.LoadInt64(calls); got > 100 {
+		t.Fatalf("got %v attempts, want at most 2 per call", got)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		opts         []Option
+		code         codes.Code
+		wantAttempts int64
+	}{
+		{"max attempts", []Option{WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond})}, codes.Unavailable, 3},
+		{"not retryable", []Option{WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond})}, codes.InvalidArgument, 1},
+		{"retryable codes", []Option{WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond, RetryableCodes: []codes.Code{codes.Aborted}})}, codes.Aborted, 3},
+		{"method over service", []Option{
+			WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond}),
+			WithRetryPolicy(echoMethod, &RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 2}),
+		}, codes.Unavailable, 2},
+		{"no budget", []Option{
+			WithRetryPolicy(testServiceName, &RetryPolicy{InitialBackoff: time.Millisecond}),
+			WithRetryBudget(0, 0),
+		}, codes.Unavailable, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client, discoveryRegistry, _ := newTestClient(t, 0, c.opts...)
+			_, calls := registerFuncServer(t, client, discoveryRegistry, failWith(c.code))
+			if _, err := echo(context.Background(), client); status.Code(err) != c.code {
+				t.Fatalf("got %v, want %v", err, c.code)
+			}
+			if attempts := atomic.LoadInt64(calls); attempts != c.wantAttempts {
+				t.Fatalf("got %v attempts, want %v", attempts, c.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &_RetryBudget{ratio: 0.5}
+	for i := 0; i < 10; i++ {
+		b.addCall()
+	}
+	retries := 0
+	for b.tryRetry() {
+		retries++
+	}
+	if retries != 5 {
+		t.Fatalf("got %v retries, want 5 of 10 calls", retries)
+	}
+	b.addCall()
+	b.addCall()
+	if !b.tryRetry() || b.tryRetry() {
+		t.Fatal("got the budget not refilled by new calls, want 1 more retry")
+	}
+}
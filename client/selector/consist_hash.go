@@ -6,9 +6,31 @@ import (
 	"github.com/spaolacci/murmur3"
 	"math/rand"
 	"sort"
+	"sync"
+)
+
+const (
+	HashAlgorithmRing       HashAlgorithm = "ring"
+	HashAlgorithmMaglev     HashAlgorithm = "maglev"
+	HashAlgorithmRendezvous HashAlgorithm = "rendezvous"
+	HashAlgorithmJump       HashAlgorithm = "jump"
 )
 
 type (
+	HashAlgorithm string
+	// _HashTable get walks the nodes in the order of hashKey and takes the first node that filter passes and accept takes,
+	// when accept takes none, e.g. every node is over the load cap, it takes the first node that filter passes,
+	// nil when filter passes none, a nil filter passes every node and a nil accept takes every node
+	_HashTable interface {
+		get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node
+	}
+	// _LazyHashTable builds the table on its first lookup, so a burst of node changes builds it once,
+	// which matters for Maglev whose table has at least 65537 entries
+	_LazyHashTable struct {
+		once  sync.Once
+		build func() _HashTable
+		table _HashTable
+	}
 	_VirtualNode struct {
 		hash uint32
 		node *registry.Node
@@ -29,24 +51,53 @@ func (c _ConsistHash) Swap(i, j int) {
 }
 
 func (u *UniversalSelector) resetConsistHash() {
+	hashAlgorithm := HashAlgorithmRing
+	if u.options != nil {
+		hashAlgorithm = u.options.hashAlgorithm
+	}
+	nodes := u.nodes // replaced rather than modified by addNode and remNode
+	u.consistHash = &_LazyHashTable{build: func() _HashTable {
+		switch hashAlgorithm {
+		case HashAlgorithmMaglev:
+			return newMaglev(nodes)
+		case HashAlgorithmRendezvous:
+			return _Rendezvous(nodes)
+		case HashAlgorithmJump:
+			return newJumpHash(nodes)
+		default:
+			return newConsistHash(nodes)
+		}
+	}}
+}
+
+func (l *_LazyHashTable) get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node {
+	l.once.Do(func() {
+		l.table = l.build()
+	})
+	return l.table.get(hashKey, filter, accept)
+}
+
+func newConsistHash(nodes []*registry.Node) _ConsistHash {
 	const virtualNodeCount = 128
-	u.consistHash = make(_ConsistHash, 0, len(u.nodes)*virtualNodeCount)
-	for _, node := range u.nodes {
+	consistHash := make(_ConsistHash, 0, len(nodes)*virtualNodeCount)
+	for _, node := range nodes {
 		bs := make([]byte, 8+len(node.Addr))
 		copy(bs[8:], node.Addr)
 		random := rand.New(rand.NewSource(0))
 		for i := 0; i < virtualNodeCount; i++ {
 			binary.BigEndian.PutUint64(bs[:8], random.Uint64())
-			u.consistHash = append(u.consistHash, &_VirtualNode{
+			consistHash = append(consistHash, &_VirtualNode{
 				hash: murmur3.Sum32(bs),
 				node: node,
 			})
 		}
 	}
-	sort.Sort(u.consistHash)
+	sort.Sort(consistHash)
+	return consistHash
 }
 
-func (c _ConsistHash) get(hashKey string) *registry.Node {
+// get walks the ring from hashKey
+func (c _ConsistHash) get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node {
 	if len(c) <= 0 {
 		return nil
 	}
@@ -57,5 +108,21 @@ func (c _ConsistHash) get(hashKey string) *registry.Node {
 	if search >= len(c) {
 		search = 0
 	}
-	return c[search].node
+	if filter == nil && accept == nil {
+		return c[search].node
+	}
+	var fallback *registry.Node
+	for i := 0; i < len(c); i++ {
+		node := c[(search+i)%len(c)].node
+		if filter != nil && !filter(node) {
+			continue
+		}
+		if accept == nil || accept(node) {
+			return node
+		}
+		if fallback == nil {
+			fallback = node
+		}
+	}
+	return fallback
 }
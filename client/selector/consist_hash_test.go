@@ -0,0 +1,182 @@
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/go-productive/micro/registry"
+)
+
+var (
+	hashAlgorithms = []HashAlgorithm{HashAlgorithmRing, HashAlgorithmMaglev, HashAlgorithmRendezvous, HashAlgorithmJump}
+)
+
+func newHashTable(hashAlgorithm HashAlgorithm, nodes []*registry.Node) _HashTable {
+	u := NewUniversalSelector(WithHashAlgorithm(hashAlgorithm))
+	u.OnInit(nodes)
+	return u.consistHash
+}
+
+func newTestNodes(n int) []*registry.Node {
+	nodes := make([]*registry.Node, 0, n)
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, &registry.Node{ServiceName: "echo.Echo", Addr: fmt.Sprintf("10.0.0.%v:8080", i+10)})
+	}
+	return nodes
+}
+
+// remapRatio is the ratio of keys whose node changes from before to after
+func remapRatio(before, after _HashTable, keyCount int) float64 {
+	remapped := 0
+	for i := 0; i < keyCount; i++ {
+		key := "key" + strconv.Itoa(i)
+		if before.get(key, nil, nil).Addr != after.get(key, nil, nil).Addr {
+			remapped++
+		}
+	}
+	return float64(remapped) / float64(keyCount)
+}
+
+func TestHashTableBalance(t *testing.T) {
+	const nodeCount, keyCount = 10, 100000
+	for _, hashAlgorithm := range hashAlgorithms {
+		t.Run(string(hashAlgorithm), func(t *testing.T) {
+			table := newHashTable(hashAlgorithm, newTestNodes(nodeCount))
+			addrMapCount := make(map[string]int)
+			for i := 0; i < keyCount; i++ {
+				addrMapCount[table.get("key"+strconv.Itoa(i), nil, nil).Addr]++
+			}
+			if len(addrMapCount) != nodeCount {
+				t.Fatalf("got %v nodes, want %v", len(addrMapCount), nodeCount)
+			}
+			for addr, count := range addrMapCount {
+				if share := float64(count) * nodeCount / keyCount; share < 0.7 || share > 1.3 {
+					t.Errorf("node:%v takes %.2f of an even share", addr, share)
+				}
+			}
+		})
+	}
+}
+
+func TestHashTableRemap(t *testing.T) {
+	const nodeCount, keyCount = 10, 100000
+	nodes := newTestNodes(nodeCount + 1)
+	for _, hashAlgorithm := range hashAlgorithms {
+		t.Run(string(hashAlgorithm), func(t *testing.T) {
+			before := newHashTable(hashAlgorithm, nodes[:nodeCount])
+			// the added node sorts last, which is the best case of jump hash
+			ratio := remapRatio(before, newHashTable(hashAlgorithm, nodes), keyCount)
+			t.Logf("add 1 to %v nodes remaps %.4f", nodeCount, ratio)
+			if want := 1.0 / (nodeCount + 1); ratio > want*1.5 {
+				t.Errorf("add remaps %.4f, want about %.4f", ratio, want)
+			}
+			remaining := nodes[1:nodeCount]
+			if hashAlgorithm == HashAlgorithmJump { // removing any node but the last shifts the buckets after it
+				remaining = nodes[:nodeCount-1]
+			}
+			ratio = remapRatio(before, newHashTable(hashAlgorithm, remaining), keyCount)
+			t.Logf("remove 1 of %v nodes remaps %.4f", nodeCount, ratio)
+			if want := 1.0 / nodeCount; ratio > want*1.5 {
+				t.Errorf("remove remaps %.4f, want about %.4f", ratio, want)
+			}
+		})
+	}
+}
+
+func TestHashTableAccept(t *testing.T) {
+	nodes := newTestNodes(10)
+	for _, hashAlgorithm := range hashAlgorithms {
+		t.Run(string(hashAlgorithm), func(t *testing.T) {
+			table := newHashTable(hashAlgorithm, nodes)
+			for i := 0; i < 1000; i++ {
+				key := "key" + strconv.Itoa(i)
+				first := table.get(key, nil, nil)
+				node := table.get(key, nil, func(node *registry.Node) bool {
+					return node.Addr != first.Addr
+				})
+				if node == nil || node.Addr == first.Addr {
+					t.Fatalf("key:%v is not spilled over from node:%v", key, first.Addr)
+				}
+			}
+		})
+	}
+}
+
+func TestHashTableFallback(t *testing.T) {
+	nodes := newTestNodes(10)
+	for _, hashAlgorithm := range hashAlgorithms {
+		t.Run(string(hashAlgorithm), func(t *testing.T) {
+			table := newHashTable(hashAlgorithm, nodes)
+			acceptNone := func(node *registry.Node) bool {
+				return false
+			}
+			for i := 0; i < 1000; i++ {
+				key := "key" + strconv.Itoa(i)
+				first := table.get(key, nil, nil)
+				// every node is over the load cap, the first node is filtered out
+				node := table.get(key, func(node *registry.Node) bool {
+					return node.Addr != first.Addr
+				}, acceptNone)
+				if node == nil || node.Addr == first.Addr {
+					t.Fatalf("key:%v got %v, want a node the filter passes", key, node)
+				}
+			}
+			last := nodes[len(nodes)-1]
+			if node := table.get("key", func(node *registry.Node) bool {
+				return node == last
+			}, nil); node != last {
+				t.Fatalf("got %v, want %v, the only node the filter passes", node, last)
+			}
+			filterNone := func(node *registry.Node) bool {
+				return false
+			}
+			if node := table.get("key", filterNone, acceptNone); node != nil {
+				t.Fatalf("got %v, want nil when the filter passes no node", node)
+			}
+		})
+	}
+}
+
+func TestLazyHashTable(t *testing.T) {
+	builds := 0
+	table := &_LazyHashTable{build: func() _HashTable {
+		builds++
+		return newMaglev(newTestNodes(3))
+	}}
+	for i := 0; i < 10; i++ {
+		table.get("key"+strconv.Itoa(i), nil, nil)
+	}
+	if builds != 1 {
+		t.Fatalf("built %v times, want 1", builds)
+	}
+}
+
+func BenchmarkHashTableGet(b *testing.B) {
+	for _, nodeCount := range []int{10, 100} {
+		nodes := newTestNodes(nodeCount)
+		for _, hashAlgorithm := range hashAlgorithms {
+			b.Run(fmt.Sprintf("%v/%v", hashAlgorithm, nodeCount), func(b *testing.B) {
+				table := newHashTable(hashAlgorithm, nodes)
+				table.get("", nil, nil) // build
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					table.get("key"+strconv.Itoa(i), nil, nil)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkHashTableBuild(b *testing.B) {
+	for _, nodeCount := range []int{10, 100} {
+		nodes := newTestNodes(nodeCount)
+		for _, hashAlgorithm := range hashAlgorithms {
+			b.Run(fmt.Sprintf("%v/%v", hashAlgorithm, nodeCount), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					newHashTable(hashAlgorithm, nodes).get("", nil, nil)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package selector
+
+import (
+	"github.com/go-productive/micro/registry"
+	"github.com/spaolacci/murmur3"
+	"strconv"
+)
+
+type (
+	// _JumpHash is Google's jump consistent hash, it needs no table and remaps only 1/n of the keys when a
+	// node is appended, nodes are ordered by addr so a node in the middle remaps more, fits numbered shards best
+	_JumpHash []*registry.Node
+)
+
+func newJumpHash(nodes []*registry.Node) _JumpHash {
+	return sortedByAddr(nodes)
+}
+
+func (j _JumpHash) get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node {
+	if len(j) <= 0 {
+		return nil
+	}
+	first := j[jumpConsistentHash(murmur3.Sum64([]byte(hashKey)), len(j))]
+	if filter == nil && accept == nil {
+		return first
+	}
+	var fallback *registry.Node
+	pick := func(node *registry.Node) bool {
+		if filter != nil && !filter(node) {
+			return false
+		}
+		if accept == nil || accept(node) {
+			return true
+		}
+		if fallback == nil {
+			fallback = node
+		}
+		return false
+	}
+	if pick(first) {
+		return first
+	}
+	for i := 1; i < len(j); i++ { // rehash the key to spill over
+		if node := j[jumpConsistentHash(murmur3.Sum64([]byte(hashKey+"#"+strconv.Itoa(i))), len(j))]; pick(node) {
+			return node
+		}
+	}
+	for _, node := range j { // the rehashes may miss the few nodes left, e.g. most nodes are filtered out
+		if pick(node) {
+			return node
+		}
+	}
+	return fallback
+}
+
+func jumpConsistentHash(key uint64, numBuckets int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,192 @@
+package selector
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-productive/micro/registry"
+	"strings"
+)
+
+const (
+	labelOperatorEquals    labelOperator = "="
+	labelOperatorNotEquals labelOperator = "!="
+	labelOperatorIn        labelOperator = "in"
+	labelOperatorNotIn     labelOperator = "notin"
+	labelOperatorExists    labelOperator = "exists"
+	labelOperatorNotExists labelOperator = "!"
+)
+
+type (
+	labelOperator string
+	// LabelSelector matches node labels, the syntax follows kubernetes label selectors, requirements are
+	// separated by commas and must all match:
+	//
+	//	version=v2, version==v2, version!=v1, tenant in (acme,foo), tenant notin (bar), canary, !canary
+	//
+	// version, zone and region fall back to the structured metadata when they are not labels
+	LabelSelector     []_LabelRequirement
+	_LabelRequirement struct {
+		key      string
+		operator labelOperator
+		values   []string
+	}
+)
+
+// WithNodeFilter narrows the nodes Select chooses from to those matching all label selectors, a selector used
+// by every call is better parsed once by MustParseLabelSelector and passed to WithLabelSelector
+func WithNodeFilter(ctx context.Context, labelSelectors ...string) (context.Context, error) {
+	parsed := make([]LabelSelector, 0, len(labelSelectors))
+	for _, s := range labelSelectors {
+		labelSelector, err := ParseLabelSelector(s)
+		if err != nil {
+			return ctx, err
+		}
+		parsed = append(parsed, labelSelector)
+	}
+	return WithLabelSelector(ctx, parsed...), nil
+}
+
+// WithLabelSelector narrows the nodes Select chooses from to those matching all label selectors
+func WithLabelSelector(ctx context.Context, labelSelectors ...LabelSelector) context.Context {
+	return WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+		for _, labelSelector := range labelSelectors {
+			if !labelSelector.Matches(node) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// MustParseLabelSelector panics on an invalid label selector, for selectors known at setup
+func MustParseLabelSelector(s string) LabelSelector {
+	labelSelector, err := ParseLabelSelector(s)
+	if err != nil {
+		panic(err)
+	}
+	return labelSelector
+}
+
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var labelSelector LabelSelector
+	for _, requirement := range splitRequirements(s) {
+		if requirement = strings.TrimSpace(requirement); requirement == "" {
+			continue
+		}
+		r, err := parseLabelRequirement(requirement)
+		if err != nil {
+			return nil, fmt.Errorf("label selector:%q %w", s, err)
+		}
+		labelSelector = append(labelSelector, r)
+	}
+	return labelSelector, nil
+}
+
+// splitRequirements splits on commas outside parentheses
+func splitRequirements(s string) []string {
+	var requirements []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(requirements, s[start:])
+}
+
+func parseLabelRequirement(s string) (_LabelRequirement, error) {
+	if fields := strings.Fields(s); len(fields) >= 2 && (fields[1] == "in" || fields[1] == "notin") {
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s[len(fields[0]):]), fields[1]))
+		if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+			return _LabelRequirement{}, fmt.Errorf("requirement:%q values must be in parentheses", s)
+		}
+		var values []string
+		for _, value := range strings.Split(rest[1:len(rest)-1], ",") {
+			values = append(values, strings.TrimSpace(value))
+		}
+		return _LabelRequirement{key: fields[0], operator: labelOperator(fields[1]), values: values}, nil
+	}
+	for _, op := range []string{"!=", "==", "="} {
+		if i := strings.Index(s, op); i >= 0 {
+			key, value := strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+len(op):])
+			if key == "" {
+				return _LabelRequirement{}, fmt.Errorf("requirement:%q has no key", s)
+			}
+			operator := labelOperatorEquals
+			if op == "!=" {
+				operator = labelOperatorNotEquals
+			}
+			return _LabelRequirement{key: key, operator: operator, values: []string{value}}, nil
+		}
+	}
+	if strings.HasPrefix(s, "!") {
+		key := strings.TrimSpace(s[1:])
+		if key == "" || strings.ContainsAny(key, " ()") {
+			return _LabelRequirement{}, fmt.Errorf("requirement:%q is invalid", s)
+		}
+		return _LabelRequirement{key: key, operator: labelOperatorNotExists}, nil
+	}
+	if strings.ContainsAny(s, " ()!") {
+		return _LabelRequirement{}, fmt.Errorf("requirement:%q is invalid", s)
+	}
+	return _LabelRequirement{key: s, operator: labelOperatorExists}, nil
+}
+
+func (l LabelSelector) Matches(node *registry.Node) bool {
+	for _, r := range l {
+		if !r.matches(node.Meta()) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *_LabelRequirement) matches(metadata *registry.Metadata) bool {
+	value, ok := labelValue(metadata, r.key)
+	switch r.operator {
+	case labelOperatorEquals:
+		return ok && value == r.values[0]
+	case labelOperatorNotEquals:
+		return !ok || value != r.values[0]
+	case labelOperatorIn:
+		return ok && contains(r.values, value)
+	case labelOperatorNotIn:
+		return !ok || !contains(r.values, value)
+	case labelOperatorExists:
+		return ok
+	default:
+		return !ok
+	}
+}
+
+func labelValue(metadata *registry.Metadata, key string) (string, bool) {
+	if value, ok := metadata.Labels[key]; ok {
+		return value, true
+	}
+	switch {
+	case key == "version" && metadata.Version != "":
+		return metadata.Version, true
+	case key == "zone" && metadata.Zone != "":
+		return metadata.Zone, true
+	case key == "region" && metadata.Region != "":
+		return metadata.Region, true
+	}
+	return "", false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
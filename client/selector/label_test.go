@@ -0,0 +1,82 @@
+package selector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func newLabeledNode(addr string, metadata *registry.Metadata) *registry.Node {
+	return &registry.Node{ServiceName: "echo.Echo", Addr: addr, Metadata: registry.EncodeMetadata(metadata)}
+}
+
+func TestLabelSelector(t *testing.T) {
+	v1 := newLabeledNode("v1", &registry.Metadata{Version: "v1", Zone: "a", Labels: map[string]string{"tenant": "acme"}})
+	v2 := newLabeledNode("v2", &registry.Metadata{Labels: map[string]string{"version": "v2", "tenant": "foo", "canary": ""}})
+	legacy := &registry.Node{ServiceName: "echo.Echo", Addr: "legacy", Metadata: []byte("raw")}
+	for _, c := range []struct {
+		labelSelector string
+		want          string
+	}{
+		{"version=v1", "v1"},
+		{"version==v2", "v2"},
+		{"version!=v1", "v2,legacy"},
+		{"tenant in (acme, bar)", "v1"},
+		{"tenant notin (acme)", "v2,legacy"},
+		{"canary", "v2"},
+		{"!canary", "v1,legacy"},
+		{"zone=a,tenant=acme", "v1"},
+		{"zone=a,tenant=foo", ""},
+		{"", "v1,v2,legacy"},
+	} {
+		labelSelector, err := ParseLabelSelector(c.labelSelector)
+		if err != nil {
+			t.Fatalf("selector:%q got %v", c.labelSelector, err)
+		}
+		var got string
+		for _, node := range []*registry.Node{v1, v2, legacy} {
+			if labelSelector.Matches(node) {
+				if got != "" {
+					got += ","
+				}
+				got += node.Addr
+			}
+		}
+		if got != c.want {
+			t.Errorf("selector:%q got %q, want %q", c.labelSelector, got, c.want)
+		}
+	}
+}
+
+func TestParseLabelSelectorError(t *testing.T) {
+	for _, s := range []string{"=v1", "tenant in acme", "a b", "!", "!(a)"} {
+		if _, err := ParseLabelSelector(s); err == nil {
+			t.Errorf("selector:%q got no error, want one", s)
+		}
+	}
+	if _, err := WithNodeFilter(context.Background(), "version=v1", "tenant in acme"); err == nil {
+		t.Fatal("got no error, want the error of the invalid selector")
+	}
+}
+
+func TestWithNodeFilter(t *testing.T) {
+	u := new(UniversalSelector)
+	u.OnInit([]*registry.Node{
+		newLabeledNode("v1", &registry.Metadata{Version: "v1"}),
+		newLabeledNode("v2", &registry.Metadata{Version: "v2", Labels: map[string]string{"tenant": "acme"}}),
+	})
+	ctx, err := WithNodeFilter(WithRoundRobin(context.Background()), "version=v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if node := u.Select(ctx); node.Addr != "v2" {
+			t.Fatalf("got %v, want v2", node.Addr)
+		}
+	}
+	// filters add up
+	if node := u.Select(WithLabelSelector(ctx, MustParseLabelSelector("tenant=foo"))); node != nil {
+		t.Fatalf("got %v, want no node matching both selectors", node.Addr)
+	}
+}
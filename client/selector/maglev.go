@@ -0,0 +1,83 @@
+package selector
+
+import (
+	"github.com/go-productive/micro/registry"
+	"github.com/spaolacci/murmur3"
+	"sort"
+)
+
+var (
+	maglevTableSizes = []uint64{65537, 131071, 262147, 524287, 1048573} // primes
+)
+
+type (
+	// _Maglev is the lookup table of Google's Maglev, a lookup is one index, and a node change
+	// remaps about 1/n of the keys
+	_Maglev []*registry.Node
+)
+
+func newMaglev(nodes []*registry.Node) _Maglev {
+	if len(nodes) <= 0 {
+		return nil
+	}
+	nodes = sortedByAddr(nodes)
+	size := maglevTableSizes[len(maglevTableSizes)-1]
+	for _, tableSize := range maglevTableSizes {
+		if tableSize >= uint64(len(nodes))*100 {
+			size = tableSize
+			break
+		}
+	}
+	offsets, skips, nexts := make([]uint64, len(nodes)), make([]uint64, len(nodes)), make([]uint64, len(nodes))
+	for i, node := range nodes {
+		offsets[i] = murmur3.Sum64WithSeed([]byte(node.Addr), 0) % size
+		skips[i] = murmur3.Sum64WithSeed([]byte(node.Addr), 1)%(size-1) + 1
+	}
+	table := make(_Maglev, size)
+	for filled := uint64(0); ; {
+		for i, node := range nodes {
+			c := (offsets[i] + nexts[i]*skips[i]) % size
+			for table[c] != nil {
+				nexts[i]++
+				c = (offsets[i] + nexts[i]*skips[i]) % size
+			}
+			table[c] = node
+			nexts[i]++
+			if filled++; filled >= size {
+				return table
+			}
+		}
+	}
+}
+
+func (m _Maglev) get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node {
+	if len(m) <= 0 {
+		return nil
+	}
+	index := murmur3.Sum64([]byte(hashKey)) % uint64(len(m))
+	if filter == nil && accept == nil {
+		return m[index]
+	}
+	var fallback *registry.Node
+	for i := uint64(0); i < uint64(len(m)); i++ {
+		node := m[(index+i)%uint64(len(m))]
+		if filter != nil && !filter(node) {
+			continue
+		}
+		if accept == nil || accept(node) {
+			return node
+		}
+		if fallback == nil {
+			fallback = node
+		}
+	}
+	return fallback
+}
+
+func sortedByAddr(nodes []*registry.Node) []*registry.Node {
+	nodes = append([]*registry.Node(nil), nodes...)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Addr < nodes[j].Addr
+	})
+	return nodes
+}
@@ -0,0 +1,135 @@
+package selector
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+const (
+	defaultLoadFactor = 1.25
+)
+
+type (
+	_Options struct {
+		decayTime     time.Duration
+		loadFactor    float64
+		hashAlgorithm HashAlgorithm
+		outlier       *_OutlierOptions
+	}
+	Option          func(*_Options)
+	_OutlierOptions struct {
+		consecutiveErrors  int
+		isErrorFunc        func(err error) bool
+		interval           time.Duration
+		baseEjectionTime   time.Duration
+		maxEjectionTime    time.Duration
+		maxEjectionPercent int
+		minimumHosts       int
+		requestVolume      int
+		stdevFactor        float64
+	}
+	OutlierOption func(*_OutlierOptions)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		decayTime:     time.Second * 10,
+		loadFactor:    defaultLoadFactor,
+		hashAlgorithm: HashAlgorithmRing,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithDecayTime is how long a latency sample takes to fade in P2CSelector's peak EWMA
+func WithDecayTime(decayTime time.Duration) Option {
+	return func(o *_Options) {
+		o.decayTime = decayTime
+	}
+}
+
+// WithLoadFactor bounds the load of consistent hashing, a node takes at most loadFactor times the average
+// in-flight calls, the rest spills over to the next node on the ring, 1.25 by default, 0 means unbounded
+func WithLoadFactor(loadFactor float64) Option {
+	return func(o *_Options) {
+		o.loadFactor = loadFactor
+	}
+}
+
+// WithHashAlgorithm chooses the consistent hashing used by WithConsistHash, HashAlgorithmRing by default
+func WithHashAlgorithm(hashAlgorithm HashAlgorithm) Option {
+	return func(o *_Options) {
+		o.hashAlgorithm = hashAlgorithm
+	}
+}
+
+// WithOutlierDetection makes UniversalSelector eject misbehaving nodes for a while, by default after 5
+// consecutive Unavailable or DeadlineExceeded, or a success rate far below the others, ejections and readmissions are reported
+// to client.WithOnEjectFunc
+func WithOutlierDetection(opts ...OutlierOption) Option {
+	return func(o *_Options) {
+		o.outlier = &_OutlierOptions{
+			consecutiveErrors: 5,
+			isErrorFunc: func(err error) bool {
+				switch status.Code(err) {
+				case codes.Unavailable, codes.DeadlineExceeded:
+					return true
+				default:
+					return false
+				}
+			},
+			interval:           time.Second * 10,
+			baseEjectionTime:   time.Second * 30,
+			maxEjectionTime:    time.Minute * 5,
+			maxEjectionPercent: 10,
+			minimumHosts:       5,
+			requestVolume:      100,
+			stdevFactor:        1.9,
+		}
+		for _, opt := range opts {
+			opt(o.outlier)
+		}
+	}
+}
+
+// WithConsecutiveErrors 0 disables ejection by consecutive errors
+func WithConsecutiveErrors(consecutiveErrors int) OutlierOption {
+	return func(o *_OutlierOptions) {
+		o.consecutiveErrors = consecutiveErrors
+	}
+}
+
+// WithIsErrorFunc tells which errors count as failures of the node, the others count as successes
+func WithIsErrorFunc(isErrorFunc func(err error) bool) OutlierOption {
+	return func(o *_OutlierOptions) {
+		o.isErrorFunc = isErrorFunc
+	}
+}
+
+// WithEjectionTime the n-th ejection of a node lasts baseEjectionTime*2^(n-1), up to maxEjectionTime
+func WithEjectionTime(baseEjectionTime, maxEjectionTime time.Duration) OutlierOption {
+	return func(o *_OutlierOptions) {
+		o.baseEjectionTime = baseEjectionTime
+		o.maxEjectionTime = maxEjectionTime
+	}
+}
+
+func WithMaxEjectionPercent(maxEjectionPercent int) OutlierOption {
+	return func(o *_OutlierOptions) {
+		o.maxEjectionPercent = maxEjectionPercent
+	}
+}
+
+// WithSuccessRate every interval, among at least minimumHosts nodes having requestVolume calls, a node whose
+// success rate is below mean-stdevFactor*stdev is ejected, 0 stdevFactor disables it
+func WithSuccessRate(interval time.Duration, minimumHosts, requestVolume int, stdevFactor float64) OutlierOption {
+	return func(o *_OutlierOptions) {
+		o.interval = interval
+		o.minimumHosts = minimumHosts
+		o.requestVolume = requestVolume
+		o.stdevFactor = stdevFactor
+	}
+}
@@ -0,0 +1,208 @@
+package selector
+
+import (
+	"github.com/go-productive/micro/registry"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// _OutlierDetector ejects a node after consecutiveErrors failures in a row, or when its success rate of an
+	// interval is below the mean of its peers by stdevFactor standard deviations, like envoy's outlier detection.
+	// The n-th ejection of a node lasts baseEjectionTime*2^(n-1) up to maxEjectionTime, n goes down by one
+	// every interval the node stays healthy, and at most maxEjectionPercent of the nodes are ejected at once
+	_OutlierDetector struct {
+		options     *_OutlierOptions
+		onEjectFunc atomic.Value // func(node *registry.Node, ejected bool)
+
+		mutex            sync.Mutex
+		addrMapStat      map[string]*_OutlierStat
+		lastEvaluateTime time.Time
+		ejectedAddrs     atomic.Value // map[string]struct{}, read by Select without the lock
+	}
+	_OutlierStat struct {
+		node              *registry.Node
+		consecutiveErrors int
+		successes         int
+		failures          int
+		ejectionCount     int
+		ejected           bool
+		readmitTimer      *time.Timer
+	}
+)
+
+func newOutlierDetector(options *_OutlierOptions) *_OutlierDetector {
+	return &_OutlierDetector{
+		options:          options,
+		addrMapStat:      make(map[string]*_OutlierStat),
+		lastEvaluateTime: time.Now(),
+	}
+}
+
+func (o *_OutlierDetector) setOnEjectFunc(onEjectFunc func(node *registry.Node, ejected bool)) {
+	o.onEjectFunc.Store(onEjectFunc)
+}
+
+func (o *_OutlierDetector) emit(nodes []*registry.Node, ejected bool) {
+	onEjectFunc, ok := o.onEjectFunc.Load().(func(node *registry.Node, ejected bool))
+	if !ok {
+		return
+	}
+	for _, node := range nodes {
+		onEjectFunc(node, ejected)
+	}
+}
+
+func (o *_OutlierDetector) add(node *registry.Node) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if stat, ok := o.addrMapStat[node.Addr]; ok {
+		stat.node = node
+		return
+	}
+	o.addrMapStat[node.Addr] = &_OutlierStat{node: node}
+}
+
+// remove forgets the node without reporting a readmission, it is gone from discovery
+func (o *_OutlierDetector) remove(addr string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stat, ok := o.addrMapStat[addr]
+	if !ok {
+		return
+	}
+	delete(o.addrMapStat, addr)
+	if stat.ejected {
+		stat.readmitTimer.Stop()
+		o.resetEjectedAddrs()
+	}
+}
+
+func (o *_OutlierDetector) isEjected(addr string) bool {
+	ejectedAddrs, _ := o.ejectedAddrs.Load().(map[string]struct{})
+	_, ok := ejectedAddrs[addr]
+	return ok
+}
+
+func (o *_OutlierDetector) hasEjected() bool {
+	ejectedAddrs, _ := o.ejectedAddrs.Load().(map[string]struct{})
+	return len(ejectedAddrs) > 0
+}
+
+func (o *_OutlierDetector) onCallDone(node *registry.Node, err error) {
+	var ejectedNodes []*registry.Node
+	defer func() {
+		o.emit(ejectedNodes, true)
+	}()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stat, ok := o.addrMapStat[node.Addr]
+	if !ok {
+		return
+	}
+	if err != nil && o.options.isErrorFunc(err) {
+		stat.failures++
+		if stat.consecutiveErrors++; o.options.consecutiveErrors > 0 && stat.consecutiveErrors >= o.options.consecutiveErrors {
+			ejectedNodes = o.eject(stat, ejectedNodes)
+		}
+	} else {
+		stat.successes++
+		stat.consecutiveErrors = 0
+	}
+	if time.Since(o.lastEvaluateTime) >= o.options.interval {
+		o.lastEvaluateTime = time.Now()
+		ejectedNodes = o.evaluate(ejectedNodes)
+	}
+}
+
+// evaluate ejects success rate outliers of the last interval, then starts a new interval
+func (o *_OutlierDetector) evaluate(ejectedNodes []*registry.Node) []*registry.Node {
+	var rates []float64
+	for _, stat := range o.addrMapStat {
+		if volume := stat.successes + stat.failures; !stat.ejected && volume >= o.options.requestVolume && volume > 0 {
+			rates = append(rates, float64(stat.successes)/float64(volume))
+		}
+	}
+	if o.options.stdevFactor > 0 && len(rates) >= o.options.minimumHosts && len(rates) > 0 {
+		var sum, squareSum float64
+		for _, rate := range rates {
+			sum += rate
+		}
+		mean := sum / float64(len(rates))
+		for _, rate := range rates {
+			squareSum += (rate - mean) * (rate - mean)
+		}
+		threshold := mean - o.options.stdevFactor*math.Sqrt(squareSum/float64(len(rates)))
+		for _, stat := range o.addrMapStat {
+			if volume := stat.successes + stat.failures; !stat.ejected && volume >= o.options.requestVolume && volume > 0 &&
+				float64(stat.successes)/float64(volume) < threshold {
+				ejectedNodes = o.eject(stat, ejectedNodes)
+			}
+		}
+	}
+	for _, stat := range o.addrMapStat {
+		stat.successes, stat.failures = 0, 0
+		if !stat.ejected && stat.ejectionCount > 0 {
+			stat.ejectionCount--
+		}
+	}
+	return ejectedNodes
+}
+
+func (o *_OutlierDetector) eject(stat *_OutlierStat, ejectedNodes []*registry.Node) []*registry.Node {
+	if stat.ejected {
+		return ejectedNodes
+	}
+	ejected := 0
+	for _, s := range o.addrMapStat {
+		if s.ejected {
+			ejected++
+		}
+	}
+	maxEjected := len(o.addrMapStat) * o.options.maxEjectionPercent / 100
+	if maxEjected < 1 && o.options.maxEjectionPercent > 0 {
+		maxEjected = 1 // like envoy, one node can always be ejected
+	}
+	if ejected >= maxEjected || ejected+1 >= len(o.addrMapStat) { // never eject the last node
+		return ejectedNodes
+	}
+	stat.ejected = true
+	stat.consecutiveErrors = 0
+	stat.ejectionCount++
+	ejectionTime := o.options.baseEjectionTime << (stat.ejectionCount - 1)
+	if ejectionTime > o.options.maxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = o.options.maxEjectionTime
+	}
+	node := stat.node
+	stat.readmitTimer = time.AfterFunc(ejectionTime, func() {
+		o.readmit(node.Addr, stat)
+	})
+	o.resetEjectedAddrs()
+	return append(ejectedNodes, node)
+}
+
+func (o *_OutlierDetector) readmit(addr string, stat *_OutlierStat) {
+	o.mutex.Lock()
+	if o.addrMapStat[addr] != stat || !stat.ejected {
+		o.mutex.Unlock()
+		return
+	}
+	stat.ejected = false
+	stat.successes, stat.failures = 0, 0
+	node := stat.node
+	o.resetEjectedAddrs()
+	o.mutex.Unlock()
+	o.emit([]*registry.Node{node}, false)
+}
+
+func (o *_OutlierDetector) resetEjectedAddrs() {
+	ejectedAddrs := make(map[string]struct{})
+	for addr, stat := range o.addrMapStat {
+		if stat.ejected {
+			ejectedAddrs[addr] = struct{}{}
+		}
+	}
+	o.ejectedAddrs.Store(ejectedAddrs)
+}
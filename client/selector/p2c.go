@@ -0,0 +1,168 @@
+package selector
+
+import (
+	"context"
+	"github.com/go-productive/micro/registry"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	minLatency     = time.Millisecond
+	initialLatency = time.Millisecond * 100 // of a node before its first call completes, it fades as real samples come
+)
+
+type (
+	// P2CSelector picks the cheaper of two random nodes, the cost of a node is its peak EWMA latency
+	// times its in-flight calls, so slow or overloaded nodes get less traffic, a new node starts at initialLatency,
+	// create it by NewP2CSelector
+	P2CSelector struct {
+		options *_Options
+
+		rwMutex      sync.RWMutex
+		nodes        []*registry.Node
+		addrMapStats map[string]*_NodeStats
+	}
+	_NodeStats struct {
+		inflight int64
+
+		mutex      sync.Mutex
+		ewma       float64 // nanoseconds
+		lastUpdate time.Time
+	}
+)
+
+func NewP2CSelector(opts ...Option) *P2CSelector {
+	return &P2CSelector{
+		options:      newOptions(opts),
+		addrMapStats: make(map[string]*_NodeStats),
+	}
+}
+
+func (p *P2CSelector) OnInit(nodes []*registry.Node) {
+	p.rwMutex.Lock()
+	defer p.rwMutex.Unlock()
+	for _, node := range nodes {
+		p.addNode(node)
+	}
+}
+
+func (p *P2CSelector) OnEvent(event *registry.Event) {
+	p.rwMutex.Lock()
+	defer p.rwMutex.Unlock()
+	switch event.Type {
+	case registry.NodeEventTypeCreate, registry.NodeEventTypeUpdate:
+		p.addNode(event.Node)
+	case registry.NodeEventTypeDelete:
+		p.remNode(event.Node)
+	}
+}
+
+func (p *P2CSelector) addNode(addNode *registry.Node) {
+	cp := make([]*registry.Node, 0, len(p.nodes)+1)
+	for _, node := range p.nodes {
+		if node.Addr != addNode.Addr {
+			cp = append(cp, node)
+		}
+	}
+	p.nodes = append(cp, addNode)
+	if _, ok := p.addrMapStats[addNode.Addr]; !ok {
+		p.addrMapStats[addNode.Addr] = &_NodeStats{ewma: float64(initialLatency), lastUpdate: time.Now()}
+	}
+}
+
+func (p *P2CSelector) remNode(remNode *registry.Node) {
+	cp := make([]*registry.Node, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		if node.Addr != remNode.Addr {
+			cp = append(cp, node)
+		}
+	}
+	p.nodes = cp
+	delete(p.addrMapStats, remNode.Addr)
+}
+
+func (p *P2CSelector) Select(ctx context.Context) *registry.Node {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	nodes := filterNodes(ctx, p.nodes)
+	if len(nodes) <= 0 {
+		return nil
+	}
+	if addr, ok := ctx.Value(specifyAddr{}).(string); ok {
+		for _, node := range nodes {
+			if node.Addr == addr {
+				return node
+			}
+		}
+		return nil
+	}
+	if len(nodes) == 1 {
+		return nodes[0]
+	}
+	i := rand.Intn(len(nodes))
+	j := rand.Intn(len(nodes) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := nodes[i], nodes[j]
+	if p.addrMapStats[b.Addr].cost(p.options.decayTime) < p.addrMapStats[a.Addr].cost(p.options.decayTime) {
+		return b
+	}
+	return a
+}
+
+func (p *P2CSelector) Nodes() []*registry.Node {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	return p.nodes
+}
+
+func (p *P2CSelector) OnCallStart(node *registry.Node) {
+	if stats := p.stats(node); stats != nil {
+		atomic.AddInt64(&stats.inflight, 1)
+	}
+}
+
+func (p *P2CSelector) OnCallDone(node *registry.Node, latency time.Duration, err error) {
+	if stats := p.stats(node); stats != nil {
+		decrementInflight(&stats.inflight)
+		stats.observe(latency, err, p.options.decayTime)
+	}
+}
+
+func (p *P2CSelector) stats(node *registry.Node) *_NodeStats {
+	p.rwMutex.RLock()
+	defer p.rwMutex.RUnlock()
+	return p.addrMapStats[node.Addr]
+}
+
+// observe keeps the peak of latency, then decays it over decayTime, an error doubles the cost,
+// so a node failing fast is not mistaken for a fast node
+func (s *_NodeStats) observe(latency time.Duration, err error, decayTime time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	sample := float64(latency)
+	if err != nil {
+		sample = math.Max(math.Max(sample, s.ewma)*2, float64(minLatency))
+	}
+	if sample > s.ewma {
+		s.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.lastUpdate)) / float64(decayTime))
+		s.ewma = s.ewma*w + sample*(1-w)
+	}
+	s.lastUpdate = now
+}
+
+func (s *_NodeStats) cost(decayTime time.Duration) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// fade a stale peak without samples, but not to 0, so the in-flight calls of a hung node still count
+	ewma := math.Max(s.ewma*math.Exp(-float64(time.Since(s.lastUpdate))/float64(decayTime)), float64(minLatency))
+	return ewma * float64(atomic.LoadInt64(&s.inflight)+1)
+}
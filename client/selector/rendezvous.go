@@ -0,0 +1,56 @@
+package selector
+
+import (
+	"github.com/go-productive/micro/registry"
+	"github.com/spaolacci/murmur3"
+	"sort"
+)
+
+type (
+	// _Rendezvous is highest random weight hashing, every node scores the key and the highest wins,
+	// a node change only remaps the keys it wins, a lookup costs O(n)
+	_Rendezvous []*registry.Node
+)
+
+func (r _Rendezvous) get(hashKey string, filter, accept func(node *registry.Node) bool) *registry.Node {
+	if len(r) <= 0 {
+		return nil
+	}
+	scores := make([]uint64, len(r))
+	best := 0
+	for i, node := range r {
+		scores[i] = rendezvousScore(node, hashKey)
+		if scores[i] > scores[best] {
+			best = i
+		}
+	}
+	if (filter == nil || filter(r[best])) && (accept == nil || accept(r[best])) {
+		return r[best]
+	}
+	indexes := make([]int, len(r))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return scores[indexes[i]] > scores[indexes[j]]
+	})
+	var fallback *registry.Node
+	for _, i := range indexes {
+		if filter != nil && !filter(r[i]) {
+			continue
+		}
+		if accept == nil || accept(r[i]) {
+			return r[i]
+		}
+		if fallback == nil {
+			fallback = r[i]
+		}
+	}
+	return fallback
+}
+
+func rendezvousScore(node *registry.Node, hashKey string) uint64 {
+	bs := make([]byte, 0, len(node.Addr)+1+len(hashKey))
+	bs = append(append(append(bs, node.Addr...), 0), hashKey...)
+	return murmur3.Sum64(bs)
+}
@@ -3,9 +3,11 @@ package selector
 import (
 	"context"
 	"github.com/go-productive/micro/registry"
+	"math"
 	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type (
@@ -15,15 +17,46 @@ type (
 		Select(ctx context.Context) *registry.Node
 		Nodes() []*registry.Node
 	}
+	// Feedback is optionally implemented by a Selector to learn how calls to the selected node went
+	Feedback interface {
+		OnCallStart(node *registry.Node)
+		OnCallDone(node *registry.Node, latency time.Duration, err error)
+	}
+	// Notifier is optionally implemented by a Selector that takes nodes out of rotation by itself, e.g. outlier detection,
+	// the client hands it the onEjectFunc to report the ejections and readmissions
+	Notifier interface {
+		SetOnEjectFunc(onEjectFunc func(node *registry.Node, ejected bool))
+	}
+	// Candidater is optionally implemented by a Selector that leaves nodes out of Select by itself, e.g. outlier detection
+	Candidater interface {
+		Candidates(ctx context.Context) []*registry.Node
+	}
+	// UniversalSelector is ready to use as a zero value, NewUniversalSelector is needed only for options
 	UniversalSelector struct {
+		options *_Options
+
 		rwMutex     sync.RWMutex
 		nodes       []*registry.Node
-		consistHash _ConsistHash
+		consistHash _HashTable
+
+		sequence           uint64
+		weightedRoundRobin _WeightedRoundRobin
 
-		sequence uint64
+		addrMapInflight map[string]*int64
+		outlierDetector *_OutlierDetector
 	}
 )
 
+func NewUniversalSelector(opts ...Option) *UniversalSelector {
+	u := &UniversalSelector{
+		options: newOptions(opts),
+	}
+	if u.options.outlier != nil {
+		u.outlierDetector = newOutlierDetector(u.options.outlier)
+	}
+	return u
+}
+
 func (u *UniversalSelector) OnInit(nodes []*registry.Node) {
 	u.rwMutex.Lock()
 	defer u.rwMutex.Unlock()
@@ -42,6 +75,15 @@ func (u *UniversalSelector) addNode(addNode *registry.Node) {
 	}
 	cp = append(cp, addNode)
 	u.nodes = cp
+	if u.addrMapInflight == nil {
+		u.addrMapInflight = make(map[string]*int64)
+	}
+	if _, ok := u.addrMapInflight[addNode.Addr]; !ok {
+		u.addrMapInflight[addNode.Addr] = new(int64)
+	}
+	if u.outlierDetector != nil {
+		u.outlierDetector.add(addNode)
+	}
 }
 
 func (u *UniversalSelector) remNode(remNode *registry.Node) {
@@ -52,6 +94,11 @@ func (u *UniversalSelector) remNode(remNode *registry.Node) {
 		}
 	}
 	u.nodes = cp
+	u.weightedRoundRobin.remove(remNode.Addr)
+	delete(u.addrMapInflight, remNode.Addr)
+	if u.outlierDetector != nil {
+		u.outlierDetector.remove(remNode.Addr)
+	}
 }
 
 func (u *UniversalSelector) OnEvent(event *registry.Event) {
@@ -69,11 +116,13 @@ func (u *UniversalSelector) OnEvent(event *registry.Event) {
 func (u *UniversalSelector) Select(ctx context.Context) *registry.Node {
 	u.rwMutex.RLock()
 	defer u.rwMutex.RUnlock()
-	if len(u.nodes) <= 0 {
+	ctx = u.withOutlierDetection(ctx)
+	nodes := filterNodes(ctx, u.nodes)
+	if len(nodes) <= 0 {
 		return nil
 	}
 	if ctx.Value(specifyAddr{}) != nil {
-		for _, node := range u.nodes {
+		for _, node := range nodes {
 			if node.Addr == ctx.Value(specifyAddr{}).(string) {
 				return node
 			}
@@ -83,12 +132,33 @@ func (u *UniversalSelector) Select(ctx context.Context) *registry.Node {
 	hashKey := ctx.Value(consistHash{})
 	switch {
 	case hashKey != nil:
-		return u.consistHash.get(hashKey.(string))
+		filterFunc, _ := ctx.Value(nodeFilter{}).(func(node *registry.Node) bool)
+		return u.consistHash.get(hashKey.(string), filterFunc, u.accept(nodes))
 	case ctx.Value(roundRobin{}) != nil:
-		return u.nodes[atomic.AddUint64(&u.sequence, 1)%uint64(len(u.nodes))]
+		return nodes[atomic.AddUint64(&u.sequence, 1)%uint64(len(nodes))]
+	case ctx.Value(weightedRoundRobin{}) != nil:
+		return u.weightedRoundRobin.next(nodes)
+	case ctx.Value(weightedRandom{}) != nil:
+		return randomByWeight(nodes)
 	default:
-		return u.nodes[rand.Intn(len(u.nodes))]
+		return nodes[rand.Intn(len(nodes))]
+	}
+}
+
+func (u *UniversalSelector) withOutlierDetection(ctx context.Context) context.Context {
+	if u.outlierDetector == nil || !u.outlierDetector.hasEjected() {
+		return ctx
 	}
+	return WithNodeFilterFunc(ctx, func(node *registry.Node) bool {
+		return !u.outlierDetector.isEjected(node.Addr)
+	})
+}
+
+// Candidates returns the nodes Select chooses from, i.e. the nodes the filters of ctx accept and outlier detection has not ejected
+func (u *UniversalSelector) Candidates(ctx context.Context) []*registry.Node {
+	u.rwMutex.RLock()
+	defer u.rwMutex.RUnlock()
+	return filterNodes(u.withOutlierDetection(ctx), u.nodes)
 }
 
 func (u *UniversalSelector) Nodes() []*registry.Node {
@@ -96,3 +166,60 @@ func (u *UniversalSelector) Nodes() []*registry.Node {
 	defer u.rwMutex.RUnlock()
 	return u.nodes
 }
+
+func (u *UniversalSelector) OnCallStart(node *registry.Node) {
+	u.rwMutex.RLock()
+	defer u.rwMutex.RUnlock()
+	if inflight, ok := u.addrMapInflight[node.Addr]; ok {
+		atomic.AddInt64(inflight, 1)
+	}
+}
+
+func (u *UniversalSelector) OnCallDone(node *registry.Node, latency time.Duration, err error) {
+	u.rwMutex.RLock()
+	if inflight, ok := u.addrMapInflight[node.Addr]; ok {
+		decrementInflight(inflight)
+	}
+	u.rwMutex.RUnlock()
+	if u.outlierDetector != nil { // out of the lock, onEjectFunc may call the selector
+		u.outlierDetector.onCallDone(node, err)
+	}
+}
+
+func (u *UniversalSelector) SetOnEjectFunc(onEjectFunc func(node *registry.Node, ejected bool)) {
+	if u.outlierDetector != nil {
+		u.outlierDetector.setOnEjectFunc(onEjectFunc)
+	}
+}
+
+// accept implements consistent hashing with bounded loads, a node accepts a call only while its in-flight calls
+// stay within loadFactor times the average of the candidates, the hash ring holds all nodes, so nodes filtered
+// out of the candidates are skipped by the filter of ctx before accept is asked
+func (u *UniversalSelector) accept(candidates []*registry.Node) func(node *registry.Node) bool {
+	loadFactor := defaultLoadFactor
+	if u.options != nil {
+		loadFactor = u.options.loadFactor
+	}
+	if loadFactor <= 0 {
+		return nil
+	}
+	var totalInflight int64
+	for _, node := range candidates {
+		totalInflight += atomic.LoadInt64(u.addrMapInflight[node.Addr])
+	}
+	loadCap := int64(math.Ceil(float64(totalInflight+1) * loadFactor / float64(len(candidates))))
+	return func(node *registry.Node) bool {
+		return atomic.LoadInt64(u.addrMapInflight[node.Addr])+1 <= loadCap
+	}
+}
+
+// decrementInflight never goes below 0, a call started before its node was removed and added again ends
+// on the counter of the new node
+func decrementInflight(inflight *int64) {
+	for {
+		n := atomic.LoadInt64(inflight)
+		if n <= 0 || atomic.CompareAndSwapInt64(inflight, n, n-1) {
+			return
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package selector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func TestBoundedLoadByDefault(t *testing.T) {
+	u := new(UniversalSelector)
+	nodes := newTestNodes(4)
+	u.OnInit(nodes)
+	ctx := WithConsistHash(context.Background(), "hot key")
+	addrMapCount := make(map[string]int)
+	for i := 0; i < 100; i++ { // none of the calls ends, so the hot key has to spill over
+		node := u.Select(ctx)
+		u.OnCallStart(node)
+		addrMapCount[node.Addr]++
+	}
+	for addr, count := range addrMapCount {
+		if count > 32 { // 1.25 times the average of 25
+			t.Errorf("node:%v takes %v of 100 in-flight calls", addr, count)
+		}
+	}
+}
+
+func TestInflightAfterReAdd(t *testing.T) {
+	u := new(UniversalSelector)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.1:8080"}
+	u.OnInit([]*registry.Node{node})
+	u.OnCallStart(node)
+	u.OnEvent(&registry.Event{Type: registry.NodeEventTypeDelete, Node: node})
+	u.OnEvent(&registry.Event{Type: registry.NodeEventTypeCreate, Node: node})
+	u.OnCallDone(node, time.Millisecond, nil) // started before the node was removed
+	if inflight := *u.addrMapInflight[node.Addr]; inflight != 0 {
+		t.Fatalf("got %v in-flight calls, want 0", inflight)
+	}
+}
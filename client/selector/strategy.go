@@ -2,12 +2,16 @@ package selector
 
 import (
 	"context"
+	"github.com/go-productive/micro/registry"
 )
 
 type (
-	consistHash struct{}
-	roundRobin  struct{}
-	specifyAddr struct{}
+	consistHash        struct{}
+	roundRobin         struct{}
+	weightedRoundRobin struct{}
+	weightedRandom     struct{}
+	specifyAddr        struct{}
+	nodeFilter         struct{}
 )
 
 func WithConsistHash(ctx context.Context, hashKey string) context.Context {
@@ -18,10 +22,58 @@ func WithRoundRobin(ctx context.Context) context.Context {
 	return with(ctx, roundRobin{}, struct{}{})
 }
 
+func WithWeightedRoundRobin(ctx context.Context) context.Context {
+	return with(ctx, weightedRoundRobin{}, struct{}{})
+}
+
+func WithWeightedRandom(ctx context.Context) context.Context {
+	return with(ctx, weightedRandom{}, struct{}{})
+}
+
 func WithSpecifyAddr(ctx context.Context, addr string) context.Context {
 	return with(ctx, specifyAddr{}, addr)
 }
 
+// WithNodeFilterFunc narrows the nodes Select chooses from to those filterFunc accepts, filters add up,
+// so it composes with the other strategies
+func WithNodeFilterFunc(ctx context.Context, filterFunc func(node *registry.Node) bool) context.Context {
+	if ctx != nil {
+		if prevFilterFunc, ok := ctx.Value(nodeFilter{}).(func(node *registry.Node) bool); ok {
+			nextFilterFunc := filterFunc
+			filterFunc = func(node *registry.Node) bool {
+				return prevFilterFunc(node) && nextFilterFunc(node)
+			}
+		}
+	}
+	return with(ctx, nodeFilter{}, filterFunc)
+}
+
+func IsSpecifyAddr(ctx context.Context) bool {
+	return ctx != nil && ctx.Value(specifyAddr{}) != nil
+}
+
+// Candidates returns the nodes s chooses from under the filters of ctx
+func Candidates(ctx context.Context, s Selector) []*registry.Node {
+	if candidater, ok := s.(Candidater); ok {
+		return candidater.Candidates(ctx)
+	}
+	return filterNodes(ctx, s.Nodes())
+}
+
+func filterNodes(ctx context.Context, nodes []*registry.Node) []*registry.Node {
+	filterFunc, ok := ctx.Value(nodeFilter{}).(func(node *registry.Node) bool)
+	if !ok {
+		return nodes
+	}
+	filtered := make([]*registry.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if filterFunc(node) {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
 func with(ctx context.Context, key, value interface{}) context.Context {
 	if ctx == nil {
 		ctx = context.TODO()
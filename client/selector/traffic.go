@@ -0,0 +1,72 @@
+package selector
+
+import (
+	"context"
+	"errors"
+	"github.com/spaolacci/murmur3"
+	"math/rand"
+	"sync"
+)
+
+const (
+	trafficHashSeed = 0x7472
+)
+
+type (
+	// TrafficPolicy splits the calls of a service between groups of nodes by weight, e.g. 95 to version=v1
+	// and 5 to version=v2, when Sticky is set the WithConsistHash key chooses the group, so a key stays in one
+	TrafficPolicy struct {
+		Splits []TrafficSplit `json:"splits"`
+		Sticky bool           `json:"sticky"`
+
+		compileOnce    sync.Once
+		compileErr     error
+		labelSelectors []LabelSelector
+		totalWeight    int
+	}
+	TrafficSplit struct {
+		LabelSelector string `json:"label_selector"` // see LabelSelector
+		Weight        int    `json:"weight"`
+	}
+)
+
+func (t *TrafficPolicy) Validate() error {
+	if t == nil {
+		return errors.New("traffic policy must not be nil")
+	}
+	t.compileOnce.Do(func() {
+		for _, split := range t.Splits {
+			if split.Weight < 0 {
+				t.compileErr = errors.New("traffic split weight must not be negative")
+				return
+			}
+			labelSelector, err := ParseLabelSelector(split.LabelSelector)
+			if err != nil {
+				t.compileErr = err
+				return
+			}
+			t.labelSelectors = append(t.labelSelectors, labelSelector)
+			t.totalWeight += split.Weight
+		}
+	})
+	return t.compileErr
+}
+
+// Apply picks a split and narrows the nodes Select chooses from to it
+func (t *TrafficPolicy) Apply(ctx context.Context) context.Context {
+	if t.Validate() != nil || t.totalWeight <= 0 {
+		return ctx
+	}
+	var r int
+	if hashKey, ok := ctx.Value(consistHash{}).(string); ok && t.Sticky {
+		r = int(murmur3.Sum32WithSeed([]byte(hashKey), trafficHashSeed) % uint32(t.totalWeight)) // seeded, not to follow the hash ring
+	} else {
+		r = rand.Intn(t.totalWeight)
+	}
+	for i, split := range t.Splits {
+		if r -= split.Weight; r < 0 {
+			return WithNodeFilterFunc(ctx, t.labelSelectors[i].Matches)
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,74 @@
+package selector
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func newCanaryPolicy(v2Weight int, sticky bool) *TrafficPolicy {
+	return &TrafficPolicy{
+		Splits: []TrafficSplit{{LabelSelector: "version=v1", Weight: 100 - v2Weight}, {LabelSelector: "version=v2", Weight: v2Weight}},
+		Sticky: sticky,
+	}
+}
+
+func newVersionSelector() *UniversalSelector {
+	u := new(UniversalSelector)
+	u.OnInit([]*registry.Node{
+		newLabeledNode("v1", &registry.Metadata{Version: "v1"}),
+		newLabeledNode("v2", &registry.Metadata{Version: "v2"}),
+	})
+	return u
+}
+
+func TestTrafficPolicyApply(t *testing.T) {
+	u, policy := newVersionSelector(), newCanaryPolicy(10, false)
+	v2 := 0
+	for i := 0; i < 10000; i++ {
+		if u.Select(policy.Apply(context.Background())).Addr == "v2" {
+			v2++
+		}
+	}
+	if share := float64(v2) / 10000; share < 0.08 || share > 0.12 {
+		t.Fatalf("got %v of the calls to v2, want about 0.1", share)
+	}
+}
+
+func TestTrafficPolicySticky(t *testing.T) {
+	u, policy := newVersionSelector(), newCanaryPolicy(50, true)
+	addrMapCount := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		ctx := WithConsistHash(context.Background(), "user"+strconv.Itoa(i))
+		addr := u.Select(policy.Apply(ctx)).Addr
+		for j := 0; j < 10; j++ {
+			if got := u.Select(policy.Apply(ctx)).Addr; got != addr {
+				t.Fatalf("got %v, want the key to stay on %v", got, addr)
+			}
+		}
+		addrMapCount[addr]++
+	}
+	if addrMapCount["v1"] < 30 || addrMapCount["v2"] < 30 {
+		t.Fatalf("got %v, want the keys split about evenly", addrMapCount)
+	}
+}
+
+func TestTrafficPolicyValidate(t *testing.T) {
+	var nilPolicy *TrafficPolicy
+	for _, policy := range []*TrafficPolicy{
+		nilPolicy,
+		{Splits: []TrafficSplit{{LabelSelector: "version=v1", Weight: -1}}},
+		{Splits: []TrafficSplit{{LabelSelector: "version in v1", Weight: 1}}},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("got no error of %+v, want one", policy)
+		}
+	}
+	// an invalid policy does not narrow the nodes
+	ctx := (&TrafficPolicy{Splits: []TrafficSplit{{LabelSelector: "version in v1", Weight: 1}}}).Apply(context.Background())
+	if nodes := Candidates(ctx, newVersionSelector()); len(nodes) != 2 {
+		t.Fatalf("got %v, want all nodes", nodes)
+	}
+}
@@ -0,0 +1,57 @@
+package selector
+
+import (
+	"github.com/go-productive/micro/registry"
+	"math/rand"
+	"sync"
+)
+
+type (
+	// _WeightedRoundRobin is nginx's smooth weighted round-robin, weights are read from nodes on every pick,
+	// so a weight changed by NodeEventTypeUpdate takes effect at once
+	_WeightedRoundRobin struct {
+		mutex                sync.Mutex
+		addrMapCurrentWeight map[string]int
+	}
+)
+
+func (w *_WeightedRoundRobin) next(nodes []*registry.Node) *registry.Node {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.addrMapCurrentWeight == nil {
+		w.addrMapCurrentWeight = make(map[string]int, len(nodes))
+	}
+	var best *registry.Node
+	totalWeight, bestWeight := 0, 0
+	for _, node := range nodes {
+		weight := node.Weight()
+		totalWeight += weight
+		currentWeight := w.addrMapCurrentWeight[node.Addr] + weight
+		w.addrMapCurrentWeight[node.Addr] = currentWeight
+		if best == nil || currentWeight > bestWeight {
+			best, bestWeight = node, currentWeight
+		}
+	}
+	w.addrMapCurrentWeight[best.Addr] -= totalWeight
+	return best
+}
+
+func (w *_WeightedRoundRobin) remove(addr string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.addrMapCurrentWeight, addr)
+}
+
+func randomByWeight(nodes []*registry.Node) *registry.Node {
+	totalWeight := 0
+	for _, node := range nodes {
+		totalWeight += node.Weight()
+	}
+	r := rand.Intn(totalWeight)
+	for _, node := range nodes {
+		if r -= node.Weight(); r < 0 {
+			return node
+		}
+	}
+	return nodes[len(nodes)-1]
+}
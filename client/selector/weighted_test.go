@@ -0,0 +1,60 @@
+package selector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func newWeightedNode(addr string, weight int) *registry.Node {
+	return &registry.Node{ServiceName: "echo.Echo", Addr: addr, Metadata: registry.EncodeMetadata(&registry.Metadata{Weight: weight})}
+}
+
+func countSelects(u *UniversalSelector, ctx context.Context, n int) map[string]int {
+	addrMapCount := make(map[string]int)
+	for i := 0; i < n; i++ {
+		addrMapCount[u.Select(ctx).Addr]++
+	}
+	return addrMapCount
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	u := new(UniversalSelector)
+	u.OnInit([]*registry.Node{newWeightedNode("a", 5), newWeightedNode("b", 1), newWeightedNode("c", 1)})
+	ctx := WithWeightedRoundRobin(context.Background())
+	var picks string
+	for i := 0; i < 7; i++ {
+		picks += u.Select(ctx).Addr
+	}
+	if picks != "aabacaa" {
+		t.Fatalf("got %v, want the smooth order aabacaa", picks)
+	}
+
+	// a weight changed by an update takes effect at once
+	u.OnEvent(&registry.Event{Type: registry.NodeEventTypeUpdate, Node: newWeightedNode("b", 5)})
+	addrMapCount := countSelects(u, ctx, 110)
+	if addrMapCount["a"] != 50 || addrMapCount["b"] != 50 || addrMapCount["c"] != 10 {
+		t.Fatalf("got %v, want 50, 50 and 10", addrMapCount)
+	}
+	u.OnEvent(&registry.Event{Type: registry.NodeEventTypeDelete, Node: newWeightedNode("a", 5)})
+	if addrMapCount := countSelects(u, ctx, 60); addrMapCount["b"] != 50 || addrMapCount["c"] != 10 {
+		t.Fatalf("got %v, want 50 and 10", addrMapCount)
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	u := new(UniversalSelector)
+	// no weight means registry.DefaultWeight
+	u.OnInit([]*registry.Node{newWeightedNode("a", 300), {ServiceName: "echo.Echo", Addr: "b"}})
+	addrMapCount := countSelects(u, WithWeightedRandom(context.Background()), 10000)
+	if share := float64(addrMapCount["a"]) / 10000; share < 0.72 || share > 0.78 {
+		t.Fatalf("got %v of the calls to a, want about 0.75", share)
+	}
+	filtered := WithNodeFilterFunc(WithWeightedRandom(context.Background()), func(node *registry.Node) bool {
+		return node.Addr == "b"
+	})
+	if addrMapCount := countSelects(u, filtered, 100); addrMapCount["b"] != 100 {
+		t.Fatalf("got %v, want all calls to the only node the filter passes", addrMapCount)
+	}
+}
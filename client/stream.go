@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"io"
+	"sync"
+)
+
+type (
+	// _ClientStream reports the end of a stream to the selector, a stream ends when RecvMsg returns an error,
+	// or after the only response of a non server streaming call, or when its context is done, or when its
+	// connection is closed, e.g. the node is deleted, so a stream the caller never finishes is not in flight forever
+	_ClientStream struct {
+		grpc.ClientStream
+		desc *grpc.StreamDesc
+
+		doneOnce        sync.Once
+		doneFunc        func(err error)
+		watchCancelFunc context.CancelFunc
+	}
+)
+
+func newClientStream(ctx context.Context, clientConn *grpc.ClientConn, clientStream grpc.ClientStream, desc *grpc.StreamDesc, doneFunc func(err error)) *_ClientStream {
+	watchCtx, watchCancelFunc := context.WithCancel(ctx)
+	s := &_ClientStream{
+		ClientStream:    clientStream,
+		desc:            desc,
+		doneFunc:        doneFunc,
+		watchCancelFunc: watchCancelFunc,
+	}
+	go func() {
+		for state := clientConn.GetState(); state != connectivity.Shutdown; state = clientConn.GetState() {
+			if !clientConn.WaitForStateChange(watchCtx, state) {
+				if ctx.Err() != nil {
+					s.done(ctx.Err())
+				}
+				return
+			}
+		}
+		s.done(errConnSetClosed)
+	}()
+	return s
+}
+
+func (s *_ClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err == io.EOF:
+		s.done(nil)
+	case err != nil:
+		s.done(err)
+	case !s.desc.ServerStreams:
+		s.done(nil)
+	}
+	return err
+}
+
+func (s *_ClientStream) done(err error) {
+	s.doneOnce.Do(func() {
+		s.watchCancelFunc()
+		s.doneFunc(err)
+	})
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+)
+
+// SetTrafficPolicies replaces the traffic policies of all services at runtime, a service without a policy is not split,
+// on error the previous policies stay in effect
+func (c *Client) SetTrafficPolicies(serviceNameMapPolicy map[string]*selector.TrafficPolicy) error {
+	for serviceName, policy := range serviceNameMapPolicy {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("service:%v illegal traffic policy:%w", serviceName, err)
+		}
+	}
+	c.trafficPolicies.Store(serviceNameMapPolicy)
+	c.options.logInfoFunc("trafficPolicies", "serviceNameMapPolicy", serviceNameMapPolicy)
+	return nil
+}
+
+func (c *Client) withTrafficPolicy(ctx context.Context, serviceName string) (context.Context, bool) {
+	serviceNameMapPolicy, _ := c.trafficPolicies.Load().(map[string]*selector.TrafficPolicy)
+	policy, ok := serviceNameMapPolicy[serviceName]
+	if !ok || selector.IsSpecifyAddr(ctx) {
+		return ctx, false
+	}
+	return policy.Apply(ctx), true
+}
+
+// watchTrafficPolicies keeps the policies in sync with a config holding the json of map[serviceName]*selector.TrafficPolicy
+func (c *Client) watchTrafficPolicies(ctx context.Context, config registry.Config, key string) {
+	configCh, err := registry.WatchConfig(ctx, config, key)
+	if err != nil {
+		panic(err)
+	}
+	update := func(value []byte) {
+		var serviceNameMapPolicy map[string]*selector.TrafficPolicy
+		if len(value) > 0 {
+			if err := json.Unmarshal(value, &serviceNameMapPolicy); err != nil {
+				c.options.logInfoFunc("watchTrafficPolicies", "key", key, "value", string(value), "err", err)
+				return
+			}
+		}
+		if err := c.SetTrafficPolicies(serviceNameMapPolicy); err != nil {
+			c.options.logInfoFunc("watchTrafficPolicies", "key", key, "value", string(value), "err", err)
+		}
+	}
+	update(<-configCh) // policies are in effect before the first call
+	go func() {
+		for value := range configCh {
+			update(value)
+		}
+	}()
+}
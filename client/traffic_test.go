@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"github.com/go-productive/micro/registry/memory"
+)
+
+// registerVersionNode registers a test server of version
+func registerVersionNode(t *testing.T, c *Client, r registry.Registry, version string) string {
+	addr := newTestServer(t)
+	metadata := registry.EncodeMetadata(&registry.Metadata{Version: version})
+	if _, err := r.Register(&registry.Node{ServiceName: testServiceName, Addr: addr, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the registered node is discovered", func() bool {
+		return c.isDiscovered(addr)
+	})
+	return addr
+}
+
+func TestTrafficPolicy(t *testing.T) {
+	policy := &selector.TrafficPolicy{Splits: []selector.TrafficSplit{{LabelSelector: "version=v2", Weight: 1}}}
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithTrafficPolicy(testServiceName, policy))
+	v1Addr := registerVersionNode(t, c, discoveryRegistry, "v1")
+	// no node in the split, e.g. v2 is not deployed yet, so calls go to all nodes
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[v1Addr] != 10 {
+		t.Fatalf("got %v, want all calls to v1", addrMapCount)
+	}
+	v2Addr := registerVersionNode(t, c, discoveryRegistry, "v2")
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[v2Addr] != 10 {
+		t.Fatalf("got %v, want all calls to v2", addrMapCount)
+	}
+
+	invalid := &selector.TrafficPolicy{Splits: []selector.TrafficSplit{{LabelSelector: "version in v1", Weight: 1}}}
+	if err := c.SetTrafficPolicies(map[string]*selector.TrafficPolicy{testServiceName: invalid}); err == nil {
+		t.Fatal("got no error, want the error of the invalid policy")
+	}
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[v2Addr] != 10 {
+		t.Fatalf("got %v, want the previous policy kept", addrMapCount)
+	}
+}
+
+func TestTrafficPolicyConfig(t *testing.T) {
+	config := memory.New()
+	config.PutConfig("traffic", []byte(`{"test.Echo":{"splits":[{"label_selector":"version=v2","weight":1}]}}`))
+	c, discoveryRegistry, _ := newTestClient(t, 0, WithTrafficPolicyConfig(config, "traffic"))
+	v1Addr := registerVersionNode(t, c, discoveryRegistry, "v1")
+	v2Addr := registerVersionNode(t, c, discoveryRegistry, "v2")
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[v2Addr] != 10 {
+		t.Fatalf("got %v, want all calls to v2", addrMapCount)
+	}
+
+	config.PutConfig("traffic", []byte(`{"test.Echo":{"splits":[{"label_selector":"version=v1","weight":1}]}}`))
+	waitFor(t, "the changed policy is in effect", func() bool {
+		addr, err := echo(context.Background(), c)
+		return err == nil && addr == v1Addr
+	})
+	config.PutConfig("traffic", []byte(`{"test.Echo":`))
+	if addrMapCount := countEchoes(t, c, 10); addrMapCount[v1Addr] != 10 {
+		t.Fatalf("got %v, want the previous policy kept on invalid json", addrMapCount)
+	}
+	config.PutConfig("traffic", nil)
+	waitFor(t, "the service is not split once the key is deleted", func() bool {
+		return countEchoes(t, c, 20)[v2Addr] > 0
+	})
+}
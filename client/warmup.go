@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"github.com/go-productive/micro/client/selector"
+	"github.com/go-productive/micro/registry"
+	"google.golang.org/grpc/connectivity"
+	"sync"
+	"time"
+)
+
+// warmup dials a discovered node in the background, so calls find its connections ready
+func (c *Client) warmup(addr string) {
+	if _, err := c.getOrCreateConnSet(addr); err != nil && err != ErrClientClosed && err != errNodeNotFound {
+		c.options.logInfoFunc("warmup", "addr", addr, "err", err)
+	}
+}
+
+// prewarm dials all known nodes and waits until their connections are ready or timeout
+func (c *Client) prewarm(timeout time.Duration) {
+	start := time.Now()
+	ctx, cancelFunc := context.WithTimeout(context.TODO(), timeout)
+	defer cancelFunc()
+	c.selectorRWMutex.RLock()
+	var nodes []*registry.Node
+	for _, s := range c.serviceNameMapSelector {
+		nodes = append(nodes, s.Nodes()...)
+	}
+	c.selectorRWMutex.RUnlock()
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			connSet, err := c.getOrCreateConnSet(addr)
+			if err != nil {
+				c.options.logInfoFunc("prewarm", "addr", addr, "err", err)
+				return
+			}
+			connSet.waitReady(ctx)
+		}(node.Addr)
+	}
+	wg.Wait()
+	c.options.logInfoFunc("prewarm", "nodes", len(nodes), "elapsed", time.Since(start))
+}
+
+// selectReadyNode prefers nodes having a ready connection, so a node still connecting does not delay calls,
+// when none is ready, e.g. right after start, it selects among all nodes
+func (c *Client) selectReadyNode(ctx context.Context, s selector.Selector) *registry.Node {
+	if !selector.IsSpecifyAddr(ctx) {
+		if node := s.Select(selector.WithNodeFilterFunc(ctx, c.isReady)); node != nil {
+			return node
+		}
+	}
+	return s.Select(ctx)
+}
+
+// isReady a node is dialed by warmup when discovered, or by the first call after its dial failed
+func (c *Client) isReady(node *registry.Node) bool {
+	c.connSetRWMutex.RLock()
+	connSet, ok := c.addrMapConnSet[node.Addr]
+	c.connSetRWMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	return connSet.isReady()
+}
+
+func (c *_ConnSet) isReady() bool {
+	select {
+	case <-c.dialedCh:
+	default:
+		return false
+	}
+	if c.err != nil {
+		return false
+	}
+	ready := false
+	for _, conn := range c.connections {
+		switch conn.GetState() {
+		case connectivity.Ready:
+			ready = true
+		case connectivity.Idle:
+			conn.Connect()
+		}
+	}
+	return ready
+}
+
+func (c *_ConnSet) waitReady(ctx context.Context) {
+	select {
+	case <-c.dialedCh:
+	case <-ctx.Done():
+		return
+	}
+	if c.err != nil {
+		return
+	}
+	for _, conn := range c.connections {
+		for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+			if state == connectivity.Idle {
+				conn.Connect()
+			}
+			if !conn.WaitForStateChange(ctx, state) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-productive/micro/registry"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+type (
+	_Bridge struct {
+		source    registry.Discovery
+		target    registry.Registry
+		statePath string
+
+		keyMapNode           map[string]*registry.Node
+		keyMapDeregisterFunc map[string]func()
+		// keyMapPendingNode holds the nodes whose register failed, they are retried with backoff
+		keyMapPendingNode map[string]*registry.Node
+		retryInterval     time.Duration
+		stateChanged      bool // keyMapNode differs from the state file
+	}
+)
+
+func newBridge(source registry.Discovery, target registry.Registry, statePath string) *_Bridge {
+	return &_Bridge{
+		source:               source,
+		target:               target,
+		statePath:            statePath,
+		keyMapNode:           make(map[string]*registry.Node),
+		keyMapDeregisterFunc: make(map[string]func()),
+		keyMapPendingNode:    make(map[string]*registry.Node),
+		retryInterval:        minRetryInterval,
+	}
+}
+
+func (b *_Bridge) run(ctx context.Context) error {
+	eventCh, serviceNameMapNodes, err := registry.WatchAndGet(ctx, b.source)
+	if err != nil {
+		return err
+	}
+	staleNodes, err := b.loadState()
+	if err != nil {
+		return err
+	}
+	b.stateChanged = len(staleNodes) > 0
+	for _, nodes := range serviceNameMapNodes {
+		for _, node := range nodes {
+			b.register(node)
+		}
+	}
+	for _, node := range staleNodes {
+		if _, ok := b.keyMapNode[toKey(node)]; !ok {
+			b.removeStale(node)
+		}
+	}
+	b.saveState()
+	retryTimer := time.NewTimer(b.retryInterval)
+	defer retryTimer.Stop()
+	for {
+		select {
+		case event, ok := <-eventCh:
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("source watch closed")
+			}
+			log.Println("msg", "handleEvent", "event", event)
+			switch event.Type {
+			case registry.NodeEventTypeCreate, registry.NodeEventTypeUpdate:
+				b.register(event.Node)
+			case registry.NodeEventTypeDelete:
+				b.deregister(event.Node)
+			}
+			b.saveState()
+		case <-retryTimer.C:
+			b.retryPending()
+			retryTimer.Reset(b.retryInterval)
+		}
+	}
+}
+
+// register registers the new version of a node before deregistering the old one,
+// so the node stays in the target if the new version fails to register
+func (b *_Bridge) register(node *registry.Node) {
+	key := toKey(node)
+	delete(b.keyMapPendingNode, key)
+	oldNode, ok := b.keyMapNode[key]
+	if ok && bytes.Equal(oldNode.Metadata, node.Metadata) {
+		return
+	}
+	deregisterFunc, err := b.target.Register(node)
+	if err != nil {
+		log.Println("msg", "register", "node", node, "err", err)
+		b.keyMapPendingNode[key] = node
+		return
+	}
+	if ok {
+		b.keyMapDeregisterFunc[key]()
+	}
+	b.keyMapNode[key] = node
+	b.keyMapDeregisterFunc[key] = deregisterFunc
+	b.stateChanged = true
+	log.Println("msg", "register", "node", node)
+}
+
+// retryPending registers the pending nodes again, the interval doubles while any of them fails
+func (b *_Bridge) retryPending() {
+	if len(b.keyMapPendingNode) <= 0 {
+		return
+	}
+	nodes := make([]*registry.Node, 0, len(b.keyMapPendingNode))
+	for _, node := range b.keyMapPendingNode {
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		b.register(node)
+	}
+	b.saveState()
+	if len(b.keyMapPendingNode) <= 0 {
+		b.retryInterval = minRetryInterval
+	} else if b.retryInterval *= 2; b.retryInterval > maxRetryInterval {
+		b.retryInterval = maxRetryInterval
+	}
+}
+
+func (b *_Bridge) deregister(node *registry.Node) {
+	key := toKey(node)
+	delete(b.keyMapPendingNode, key)
+	if deregisterFunc, ok := b.keyMapDeregisterFunc[key]; ok {
+		deregisterFunc()
+		delete(b.keyMapDeregisterFunc, key)
+		delete(b.keyMapNode, key)
+		b.stateChanged = true
+		log.Println("msg", "deregister", "node", node)
+	}
+}
+
+// removeStale removes a node mirrored by a previous run that is gone from the source,
+// registry.Registry can only delete what it registered, so the node is registered and deregistered at once
+func (b *_Bridge) removeStale(node *registry.Node) {
+	deregisterFunc, err := b.target.Register(node)
+	if err != nil {
+		log.Println("msg", "removeStale", "node", node, "err", err)
+		return
+	}
+	deregisterFunc()
+	log.Println("msg", "removeStale", "node", node)
+}
+
+func (b *_Bridge) loadState() ([]*registry.Node, error) {
+	bs, err := ioutil.ReadFile(b.statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nodes []*registry.Node
+	return nodes, json.Unmarshal(bs, &nodes)
+}
+
+// saveState records the mirrored nodes, so the next run knows which target nodes are stale,
+// it writes only when they changed, e.g. not for an update with the same metadata or a failed retry
+func (b *_Bridge) saveState() {
+	if !b.stateChanged {
+		return
+	}
+	nodes := make([]*registry.Node, 0, len(b.keyMapNode))
+	for _, node := range b.keyMapNode {
+		nodes = append(nodes, node)
+	}
+	bs, err := json.Marshal(nodes)
+	if err != nil {
+		log.Println("msg", "saveState", "err", err)
+		return
+	}
+	tmpPath := b.statePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bs, 0644); err != nil {
+		log.Println("msg", "saveState", "err", err)
+		return
+	}
+	if err := os.Rename(tmpPath, b.statePath); err != nil {
+		log.Println("msg", "saveState", "err", err)
+		return
+	}
+	b.stateChanged = false
+}
+
+func toKey(node *registry.Node) string {
+	return node.ServiceName + "/" + node.Addr
+}
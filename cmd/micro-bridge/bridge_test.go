@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+	"github.com/go-productive/micro/registry/memory"
+)
+
+type (
+	// _FlakyRegistry fails Register while down
+	_FlakyRegistry struct {
+		registry.Registry
+		mutex sync.Mutex
+		down  bool
+	}
+)
+
+func (f *_FlakyRegistry) Register(node *registry.Node) (func(), error) {
+	f.mutex.Lock()
+	down := f.down
+	f.mutex.Unlock()
+	if down {
+		return nil, errors.New("down")
+	}
+	return f.Registry.Register(node)
+}
+
+func (f *_FlakyRegistry) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.down = down
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event) *registry.Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %v", what)
+}
+
+func readState(t *testing.T, statePath string) []*registry.Node {
+	t.Helper()
+	bs, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		return nil
+	}
+	var nodes []*registry.Node
+	if err := json.Unmarshal(bs, &nodes); err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+func runBridge(t *testing.T, b *_Bridge) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- b.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancelFunc()
+		if err := <-errCh; err != nil {
+			t.Errorf("got %v, want a clean exit on shutdown", err)
+		}
+	})
+}
+
+func TestMirror(t *testing.T) {
+	source, target := memory.New(), memory.New()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, _, err := target.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runBridge(t, newBridge(source, target, filepath.Join(t.TempDir(), "state.json")))
+
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	if _, err := source.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != node.Addr {
+		t.Fatalf("got %v, want create of %v", event, node)
+	}
+	updatedNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: []byte(`{"zone":"a"}`)}
+	deregisterFunc, err := source.Register(updatedNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeUpdate || string(event.Node.Metadata) != string(updatedNode.Metadata) {
+		t.Fatalf("got %v, want update of %v", event, updatedNode)
+	}
+	deregisterFunc()
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeDelete || event.Node.Addr != node.Addr {
+		t.Fatalf("got %v, want delete of %v", event, node)
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	source, target := memory.New(), memory.New()
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	if _, err := source.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	staleNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"}
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	bs, err := json.Marshal([]*registry.Node{node, staleNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(statePath, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, _, err := target.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runBridge(t, newBridge(source, target, statePath))
+
+	for _, want := range []*registry.Event{
+		{Type: registry.NodeEventTypeCreate, Node: node},
+		{Type: registry.NodeEventTypeCreate, Node: staleNode},
+		{Type: registry.NodeEventTypeDelete, Node: staleNode},
+	} {
+		if event := receiveEvent(t, eventCh); event.Type != want.Type || event.Node.Addr != want.Node.Addr {
+			t.Fatalf("got %v, want %v", event, want)
+		}
+	}
+	waitFor(t, "the state without the stale node", func() bool {
+		nodes := readState(t, statePath)
+		return len(nodes) == 1 && nodes[0].Addr == node.Addr
+	})
+}
+
+func TestSaveStateOnChange(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	b := newBridge(memory.New(), memory.New(), statePath)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	b.register(node)
+	b.saveState()
+	if nodes := readState(t, statePath); len(nodes) != 1 {
+		t.Fatalf("got %v, want %v", nodes, node)
+	}
+	if err := os.Remove(statePath); err != nil {
+		t.Fatal(err)
+	}
+	b.register(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"})
+	b.deregister(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"})
+	b.saveState()
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want no write when the mirrored nodes are the same", err)
+	}
+	b.deregister(node)
+	b.saveState()
+	if nodes := readState(t, statePath); nodes == nil || len(nodes) != 0 {
+		t.Fatalf("got %v, want an empty state written", nodes)
+	}
+}
+
+func TestRetryPending(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	target := &_FlakyRegistry{Registry: memory.New(), down: true}
+	b := newBridge(memory.New(), target, statePath)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	b.register(node)
+	b.retryPending()
+	if _, ok := b.keyMapPendingNode[toKey(node)]; !ok || b.retryInterval != minRetryInterval*2 {
+		t.Fatalf("got pending %v with interval %v, want the node pending and the interval doubled", ok, b.retryInterval)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("got %v, want no state written for a failed register", err)
+	}
+
+	target.setDown(false)
+	b.retryPending()
+	if _, ok := b.keyMapNode[toKey(node)]; !ok || len(b.keyMapPendingNode) != 0 || b.retryInterval != minRetryInterval {
+		t.Fatalf("got mirrored %v with interval %v, want the node mirrored and the interval reset", ok, b.retryInterval)
+	}
+	if nodes := readState(t, statePath); len(nodes) != 1 || nodes[0].Addr != node.Addr {
+		t.Fatalf("got %v, want %v", nodes, node)
+	}
+}
@@ -0,0 +1,109 @@
+// Command micro-bridge mirrors the nodes of one registry into another, e.g. etcd to consul:
+//
+//	micro-bridge -from etcd://127.0.0.1:2379/services -to consul://127.0.0.1:8500?tag=micro
+//
+// Supported urls:
+//
+//	etcd://host:port[,host:port...][/prefix]
+//	consul://host:port[?tag=micro&token=xxx]
+//	file:///path/to/nodes.yaml (source only)
+//	gossip://bind_host:port[?seeds=host:port,host:port&advertise=host:port]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-productive/micro/registry"
+	"github.com/go-productive/micro/registry/consul"
+	"github.com/go-productive/micro/registry/etcdv3"
+	"github.com/go-productive/micro/registry/file"
+	"github.com/go-productive/micro/registry/gossip"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	from := flag.String("from", "", "source registry url")
+	to := flag.String("to", "", "target registry url")
+	statePath := flag.String("state", "micro-bridge.state.json", "file recording mirrored nodes, used to remove stale nodes on restart")
+	flag.Parse()
+
+	source, err := newDiscovery(*from)
+	if err != nil {
+		log.Fatalln("msg", "-from", "err", err)
+	}
+	target, err := newRegistry(*to)
+	if err != nil {
+		log.Fatalln("msg", "-to", "err", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := newBridge(source, target, *statePath).run(ctx); err != nil {
+		log.Fatalln("msg", "run", "err", err)
+	}
+	log.Println("msg", "exit")
+}
+
+func newDiscovery(rawURL string) (registry.Discovery, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "file" {
+		return file.New(u.Path), nil
+	}
+	discoveryRegistry, err := newDiscoveryRegistry(u)
+	if err != nil {
+		return nil, err
+	}
+	return discoveryRegistry, nil
+}
+
+func newRegistry(rawURL string) (registry.Registry, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	discoveryRegistry, err := newDiscoveryRegistry(u)
+	if err != nil {
+		return nil, err
+	}
+	return discoveryRegistry, nil
+}
+
+func newDiscoveryRegistry(u *url.URL) (registry.DiscoveryRegistry, error) {
+	query := u.Query()
+	switch u.Scheme {
+	case "etcd":
+		var opts []etcdv3.Option
+		if prefix := strings.TrimSuffix(u.Path, "/"); prefix != "" {
+			opts = append(opts, etcdv3.WithPrefix(prefix))
+		}
+		return etcdv3.New(strings.Split(u.Host, ","), opts...), nil
+	case "consul":
+		var opts []consul.Option
+		if tag := query.Get("tag"); tag != "" {
+			opts = append(opts, consul.WithTag(tag))
+		}
+		if token := query.Get("token"); token != "" {
+			opts = append(opts, consul.WithToken(token))
+		}
+		return consul.New("http://"+u.Host, opts...), nil
+	case "gossip":
+		var opts []gossip.Option
+		if seeds := query.Get("seeds"); seeds != "" {
+			opts = append(opts, gossip.WithSeeds(strings.Split(seeds, ",")...))
+		}
+		if advertise := query.Get("advertise"); advertise != "" {
+			opts = append(opts, gossip.WithAdvertiseAddr(advertise))
+		}
+		return gossip.New(u.Host, opts...), nil
+	default:
+		return nil, fmt.Errorf("unsupported registry url:%v", u)
+	}
+}
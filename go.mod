@@ -3,7 +3,11 @@ module github.com/go-productive/micro
 go 1.16
 
 require (
+	github.com/golang/protobuf v1.5.2
 	github.com/spaolacci/murmur3 v1.1.0
+	go.etcd.io/etcd/api/v3 v3.5.2 // registry/etcdv3 imports v3rpc/rpctypes, go commands since 1.17 refuse it as an implicit requirement
 	go.etcd.io/etcd/client/v3 v3.5.2
 	google.golang.org/grpc v1.45.0
+	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-productive/micro/registry"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type (
+	// _Discovery saves the last known nodes of the backend to a file, when the backend is down at startup
+	// it serves the saved nodes and keeps reconnecting, the difference found after reconnecting is sent as events.
+	// The backend must not block or panic in its constructor while it is down, e.g. etcdv3 needs etcdv3.WithNonBlockingDial()
+	_Discovery struct {
+		discovery registry.Discovery
+		path      string
+		options   *_Options
+	}
+)
+
+func New(discovery registry.Discovery, path string, opts ...Option) *_Discovery {
+	return &_Discovery{
+		discovery: discovery,
+		path:      path,
+		options:   newOptions(opts),
+	}
+}
+
+func (d *_Discovery) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_Discovery) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	eventCh, serviceNameMapNodes, err := registry.WatchAndGet(ctx, d.discovery)
+	if err == nil {
+		d.save(serviceNameMapNodes)
+		eventChan := make(chan *registry.Event, 1)
+		go func() {
+			defer close(eventChan)
+			d.forward(ctx, eventCh, serviceNameMapNodes, eventChan)
+		}()
+		return eventChan, serviceNameMapNodes, nil
+	}
+	cachedServiceNameMapNodes, loadErr := d.load()
+	if loadErr != nil {
+		d.options.logErrorFunc("WatchAndGet", "path", d.path, "err", loadErr)
+		return nil, nil, err
+	}
+	d.options.logErrorFunc("WatchAndGet", "err", err, "cached", cachedServiceNameMapNodes)
+	eventChan := make(chan *registry.Event, 1)
+	go d.reconnect(ctx, cachedServiceNameMapNodes, eventChan)
+	return eventChan, cachedServiceNameMapNodes, nil
+}
+
+func (d *_Discovery) reconnect(ctx context.Context, cachedServiceNameMapNodes map[string][]*registry.Node, eventCh chan<- *registry.Event) {
+	defer close(eventCh)
+	for t := d.options.minRetryInterval; ; {
+		timer := time.NewTimer(t)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backendEventCh, serviceNameMapNodes, err := registry.WatchAndGet(ctx, d.discovery)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			d.options.logErrorFunc("reconnect", "err", err)
+			if t <<= 1; t > d.options.maxRetryInterval {
+				t = d.options.maxRetryInterval
+			}
+			continue
+		}
+		for _, event := range registry.Diff(cachedServiceNameMapNodes, serviceNameMapNodes) {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		d.save(serviceNameMapNodes)
+		d.forward(ctx, backendEventCh, serviceNameMapNodes, eventCh)
+		return
+	}
+}
+
+// forward passes backend events through, the snapshot is saved at most once per save interval however busy the backend is,
+// and once more when forwarding ends
+func (d *_Discovery) forward(ctx context.Context, backendEventCh <-chan *registry.Event, serviceNameMapNodes map[string][]*registry.Node, eventCh chan<- *registry.Event) {
+	serviceNameMapAddrMapNode := make(map[string]map[string]*registry.Node, len(serviceNameMapNodes))
+	for serviceName, nodes := range serviceNameMapNodes {
+		serviceNameMapAddrMapNode[serviceName] = make(map[string]*registry.Node, len(nodes))
+		for _, node := range nodes {
+			serviceNameMapAddrMapNode[serviceName][node.Addr] = node
+		}
+	}
+	var saveTimer *time.Timer
+	var saveTimerCh <-chan time.Time
+	defer func() {
+		if saveTimer != nil {
+			saveTimer.Stop()
+			d.save(toServiceNameMapNodes(serviceNameMapAddrMapNode))
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-saveTimerCh:
+			saveTimer, saveTimerCh = nil, nil
+			d.save(toServiceNameMapNodes(serviceNameMapAddrMapNode))
+		case event, ok := <-backendEventCh:
+			if !ok {
+				return
+			}
+			node := event.Node
+			if event.Type == registry.NodeEventTypeDelete {
+				delete(serviceNameMapAddrMapNode[node.ServiceName], node.Addr)
+			} else {
+				if serviceNameMapAddrMapNode[node.ServiceName] == nil {
+					serviceNameMapAddrMapNode[node.ServiceName] = make(map[string]*registry.Node)
+				}
+				serviceNameMapAddrMapNode[node.ServiceName][node.Addr] = node
+			}
+			if saveTimer == nil {
+				saveTimer = time.NewTimer(d.options.saveInterval)
+				saveTimerCh = saveTimer.C
+			}
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (d *_Discovery) load() (map[string][]*registry.Node, error) {
+	bs, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var serviceNameMapNodes map[string][]*registry.Node
+	return serviceNameMapNodes, json.Unmarshal(bs, &serviceNameMapNodes)
+}
+
+// save writes a temp file then renames it, so a crash never leaves a half written snapshot
+func (d *_Discovery) save(serviceNameMapNodes map[string][]*registry.Node) {
+	bs, err := json.Marshal(serviceNameMapNodes)
+	if err != nil {
+		d.options.logErrorFunc("save", "err", err)
+		return
+	}
+	tmpPath := d.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, bs, 0644); err != nil {
+		d.options.logErrorFunc("save", "path", tmpPath, "err", err)
+		return
+	}
+	if err := os.Rename(tmpPath, d.path); err != nil {
+		d.options.logErrorFunc("save", "path", d.path, "err", err)
+	}
+}
+
+func toServiceNameMapNodes(serviceNameMapAddrMapNode map[string]map[string]*registry.Node) map[string][]*registry.Node {
+	serviceNameMapNodes := make(map[string][]*registry.Node, len(serviceNameMapAddrMapNode))
+	for serviceName, addrMapNode := range serviceNameMapAddrMapNode {
+		for _, node := range addrMapNode {
+			serviceNameMapNodes[serviceName] = append(serviceNameMapNodes[serviceName], node)
+		}
+	}
+	return serviceNameMapNodes
+}
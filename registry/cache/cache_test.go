@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+	"github.com/go-productive/micro/registry/memory"
+)
+
+type (
+	// _FlakyDiscovery fails WatchAndGet while down, like a backend that cannot be reached
+	_FlakyDiscovery struct {
+		registry.DiscoveryRegistry
+
+		mutex sync.Mutex
+		down  bool
+		calls int
+	}
+)
+
+var (
+	errDown = errors.New("backend is down")
+)
+
+func (d *_FlakyDiscovery) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_FlakyDiscovery) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	d.mutex.Lock()
+	d.calls++
+	down := d.down
+	d.mutex.Unlock()
+	if down {
+		return nil, nil, errDown
+	}
+	return registry.WatchAndGet(ctx, d.DiscoveryRegistry)
+}
+
+func (d *_FlakyDiscovery) setDown(down bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.down = down
+}
+
+func (d *_FlakyDiscovery) callCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.calls
+}
+
+func newTestDiscovery(backend registry.Discovery, path string) *_Discovery {
+	return New(backend, path,
+		WithRetryInterval(time.Millisecond*10, time.Millisecond*20),
+		WithSaveInterval(time.Millisecond*20),
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {}),
+	)
+}
+
+func register(t *testing.T, r registry.Registry, addr string) func() {
+	t.Helper()
+	deregisterFunc, err := r.Register(&registry.Node{ServiceName: "echo.Echo", Addr: addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deregisterFunc
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event) *registry.Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func waitSaved(t *testing.T, d *_Discovery, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		serviceNameMapNodes, err := d.load()
+		if err == nil && len(serviceNameMapNodes["echo.Echo"]) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v %v, want %v saved nodes", serviceNameMapNodes, err, want)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestServeSnapshotWhileDown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	backend := &_FlakyDiscovery{DiscoveryRegistry: memory.New()}
+	register(t, backend, "10.0.0.10:8080")
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	d := newTestDiscovery(backend, path)
+	eventCh, _, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register(t, backend, "10.0.0.11:8080")
+	if event := receiveEvent(t, eventCh); event.Node.Addr != "10.0.0.11:8080" {
+		t.Fatalf("got %v, want create of 10.0.0.11:8080", event)
+	}
+	waitSaved(t, d, 2)
+	cancelFunc()
+	for range eventCh {
+	}
+
+	backend.setDown(true)
+	ctx, cancelFunc = context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, serviceNameMapNodes, err := newTestDiscovery(backend, path).WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serviceNameMapNodes["echo.Echo"]) != 2 {
+		t.Fatalf("got %v, want the 2 saved nodes", serviceNameMapNodes)
+	}
+
+	// after reconnecting, only the difference to the snapshot is sent
+	register(t, backend, "10.0.0.12:8080")
+	backend.setDown(false)
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != "10.0.0.12:8080" {
+		t.Fatalf("got %v, want create of 10.0.0.12:8080", event)
+	}
+	select {
+	case event := <-eventCh:
+		t.Fatalf("got %v, want no more event", event)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestDownWithoutSnapshot(t *testing.T) {
+	backend := &_FlakyDiscovery{DiscoveryRegistry: memory.New(), down: true}
+	_, _, err := newTestDiscovery(backend, filepath.Join(t.TempDir(), "nodes.json")).WatchAndGetContext(context.Background())
+	if err != errDown {
+		t.Fatalf("got %v, want %v", err, errDown)
+	}
+}
+
+func TestReconnectCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	backend := &_FlakyDiscovery{DiscoveryRegistry: memory.New()}
+	register(t, backend, "10.0.0.10:8080")
+	d := newTestDiscovery(backend, path)
+	d.save(map[string][]*registry.Node{"echo.Echo": {{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}}})
+	backend.setDown(true)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, _, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelFunc()
+	select {
+	case _, ok := <-eventCh:
+		if ok {
+			t.Fatal("got an event, want the channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reconnect does not stop after ctx is done")
+	}
+	calls := backend.callCount()
+	time.Sleep(time.Millisecond * 50)
+	if got := backend.callCount(); got != calls {
+		t.Fatalf("got %v calls, want %v, reconnect must stop retrying", got, calls)
+	}
+}
+
+func TestCoalesceSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.json")
+	backend := &_FlakyDiscovery{DiscoveryRegistry: memory.New()}
+	d := New(backend, path,
+		WithSaveInterval(time.Hour),
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {}),
+	)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, _, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"10.0.0.10:8080", "10.0.0.11:8080"} {
+		register(t, backend, addr)
+		receiveEvent(t, eventCh)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if serviceNameMapNodes, err := d.load(); err != nil || len(serviceNameMapNodes["echo.Echo"]) != 0 {
+		t.Fatalf("got %v %v, want the events not saved one by one", serviceNameMapNodes, err)
+	}
+
+	// the pending snapshot is saved when forwarding ends
+	cancelFunc()
+	for range eventCh {
+	}
+	waitSaved(t, d, 2)
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"log"
+	"time"
+)
+
+type (
+	_Options struct {
+		minRetryInterval time.Duration
+		maxRetryInterval time.Duration
+		saveInterval     time.Duration
+		logErrorFunc     func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		minRetryInterval: time.Second,
+		maxRetryInterval: time.Second * 30,
+		saveInterval:     time.Second,
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRetryInterval sets the backoff of reconnecting the backend while serving the cached snapshot
+func WithRetryInterval(minRetryInterval, maxRetryInterval time.Duration) Option {
+	return func(o *_Options) {
+		o.minRetryInterval = minRetryInterval
+		o.maxRetryInterval = maxRetryInterval
+	}
+}
+
+// WithSaveInterval sets how often the snapshot is saved at most while the backend keeps changing
+func WithSaveInterval(saveInterval time.Duration) Option {
+	return func(o *_Options) {
+		o.saveInterval = saveInterval
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
@@ -0,0 +1,440 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-productive/micro"
+	"github.com/go-productive/micro/registry"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metaKeyMetadata = "micro_metadata"
+)
+
+var (
+	errNotFound = errors.New("consul: not found")
+)
+
+type (
+	_DiscoveryRegistry struct {
+		addr    string
+		options *_Options
+
+		registrationMutex        sync.Mutex
+		serviceIDMapRegistration map[string]*_Registration
+	}
+	// _Registration stops the keepalive of a node once it is deregistered or replaced by a later Register,
+	// doneCh is closed when the keepalive returned, so it can not register the node again after its deregister
+	_Registration struct {
+		ctx        context.Context
+		cancelFunc context.CancelFunc
+		doneCh     chan struct{}
+	}
+	_AgentServiceRegistration struct {
+		ID      string            `json:"ID"`
+		Name    string            `json:"Name"`
+		Tags    []string          `json:"Tags"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta,omitempty"`
+		Check   *_AgentCheck      `json:"Check"`
+	}
+	_AgentCheck struct {
+		CheckID                        string `json:"CheckID"`
+		TTL                            string `json:"TTL"`
+		DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+	}
+	_ServiceEntry struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service struct {
+			Service string            `json:"Service"`
+			Address string            `json:"Address"`
+			Port    int               `json:"Port"`
+			Meta    map[string]string `json:"Meta"`
+		} `json:"Service"`
+	}
+)
+
+// New addr is the consul agent http endpoint, e.g. http://127.0.0.1:8500
+func New(addr string, opts ...Option) *_DiscoveryRegistry {
+	return &_DiscoveryRegistry{
+		addr:                     strings.TrimSuffix(addr, "/"),
+		options:                  newOptions(opts),
+		serviceIDMapRegistration: make(map[string]*_Registration),
+	}
+}
+
+func (d *_DiscoveryRegistry) Register(node *registry.Node) (func(), error) {
+	if err := d.register(context.TODO(), node); err != nil {
+		return nil, err
+	}
+	serviceID := toServiceID(node)
+	reg := &_Registration{doneCh: make(chan struct{})}
+	reg.ctx, reg.cancelFunc = context.WithCancel(context.Background())
+	d.registrationMutex.Lock()
+	replaced, ok := d.serviceIDMapRegistration[serviceID]
+	d.serviceIDMapRegistration[serviceID] = reg
+	d.registrationMutex.Unlock()
+	if ok {
+		replaced.stop()
+	}
+	go func() {
+		defer close(reg.doneCh)
+		ticker := time.NewTicker(d.options.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-reg.ctx.Done():
+				return
+			case <-ticker.C:
+				d.keepalive(reg.ctx, node)
+			}
+		}
+	}()
+	return func() {
+		d.registrationMutex.Lock()
+		current := d.serviceIDMapRegistration[serviceID] == reg
+		if current {
+			delete(d.serviceIDMapRegistration, serviceID)
+		}
+		d.registrationMutex.Unlock()
+		reg.stop()
+		if !current { // replaced by a later Register of the same node, which owns the service now
+			return
+		}
+		timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
+		defer cancelFunc()
+		_, _ = d.do(timeout, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(serviceID), nil, nil, nil)
+	}, nil
+}
+
+func (r *_Registration) stop() {
+	r.cancelFunc()
+	<-r.doneCh
+}
+
+func (d *_DiscoveryRegistry) register(ctx context.Context, node *registry.Node) error {
+	host, portStr, err := net.SplitHostPort(node.Addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	serviceID := toServiceID(node)
+	reg := &_AgentServiceRegistration{
+		ID:      serviceID,
+		Name:    node.ServiceName,
+		Tags:    []string{d.options.tag},
+		Address: host,
+		Port:    port,
+		Check: &_AgentCheck{
+			CheckID:                        toCheckID(serviceID),
+			TTL:                            d.options.ttl.String(),
+			DeregisterCriticalServiceAfter: d.options.deregisterCriticalServiceAfter.String(),
+		},
+	}
+	if len(node.Metadata) > 0 {
+		reg.Meta = map[string]string{metaKeyMetadata: base64.StdEncoding.EncodeToString(node.Metadata)}
+	}
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+	defer cancelFunc()
+	if _, err := d.do(timeout, http.MethodPut, "/v1/agent/service/register", nil, reg, nil); err != nil {
+		return err
+	}
+	return d.passCheck(timeout, serviceID)
+}
+
+func (d *_DiscoveryRegistry) passCheck(ctx context.Context, serviceID string) error {
+	_, err := d.do(ctx, http.MethodPut, "/v1/agent/check/pass/"+url.PathEscape(toCheckID(serviceID)), nil, nil, nil)
+	return err
+}
+
+func (d *_DiscoveryRegistry) keepalive(ctx context.Context, node *registry.Node) {
+	for i, t := 0, time.Millisecond*10; i < 5 && ctx.Err() == nil; i, t = i+1, t<<1 {
+		timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+		err := d.passCheck(timeout, toServiceID(node))
+		cancelFunc()
+		if err == nil {
+			return
+		}
+		if err == errNotFound { // agent lost the service, e.g. restarted or deregistered it as critical
+			if err = d.register(ctx, node); err == nil {
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		d.options.logErrorFunc("keepalive", "err", err, "node", node)
+		sleep(ctx, t)
+	}
+}
+
+func (d *_DiscoveryRegistry) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_DiscoveryRegistry) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+	defer cancelFunc()
+	serviceNames, catalogIndex, err := d.serviceNames(timeout, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	serviceNameMapNodes := make(map[string][]*registry.Node, len(serviceNames))
+	serviceNameMapIndex := make(map[string]uint64, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		nodes, index, err := d.healthyNodes(timeout, serviceName, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceNameMapNodes[serviceName], serviceNameMapIndex[serviceName] = nodes, index
+	}
+
+	eventChan := make(chan *registry.Event, 1)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	watching := make(map[string]bool, len(serviceNames))
+	cataloged := toSet(serviceNames)
+	stopIfGone := func(serviceName string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if cataloged[serviceName] {
+			return false
+		}
+		delete(watching, serviceName) // watched again from scratch if the service comes back
+		return true
+	}
+	watchService := func(serviceName string, nodes []*registry.Node, index uint64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !watching[serviceName] {
+			watching[serviceName] = true
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.watchService(ctx, serviceName, nodes, index, eventChan, stopIfGone)
+				if ctx.Err() != nil {
+					mutex.Lock()
+					delete(watching, serviceName)
+					mutex.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Add(1) // the catalog watch holds the count above 0 while it starts service watches
+	for _, serviceName := range serviceNames {
+		watchService(serviceName, serviceNameMapNodes[serviceName], serviceNameMapIndex[serviceName])
+	}
+	go func() {
+		defer wg.Done()
+		d.watchCatalog(ctx, catalogIndex, func(serviceNames []string) {
+			mutex.Lock()
+			cataloged = toSet(serviceNames)
+			mutex.Unlock()
+			for _, serviceName := range serviceNames {
+				watchService(serviceName, nil, 0)
+			}
+		})
+	}()
+	go func() {
+		wg.Wait()
+		close(eventChan)
+	}()
+	return eventChan, serviceNameMapNodes, nil
+}
+
+func (d *_DiscoveryRegistry) watchCatalog(ctx context.Context, index uint64, onServiceNames func(serviceNames []string)) {
+	for ctx.Err() == nil {
+		timeout, cancelFunc := context.WithTimeout(ctx, d.options.waitTime+micro.Timeout)
+		serviceNames, newIndex, err := d.serviceNames(timeout, index)
+		cancelFunc()
+		if err != nil {
+			if ctx.Err() == nil {
+				d.options.logErrorFunc("watchCatalog", "err", err)
+				sleep(ctx, time.Second)
+			}
+			continue
+		}
+		onServiceNames(serviceNames)
+		index = resetIndex(index, newIndex)
+	}
+}
+
+// watchService returns when ctx is done, or the service has no node left and is gone from the catalog
+func (d *_DiscoveryRegistry) watchService(ctx context.Context, serviceName string, nodes []*registry.Node, index uint64, eventCh chan<- *registry.Event, stopIfGone func(serviceName string) bool) {
+	for ctx.Err() == nil {
+		timeout, cancelFunc := context.WithTimeout(ctx, d.options.waitTime+micro.Timeout)
+		newNodes, newIndex, err := d.healthyNodes(timeout, serviceName, index)
+		cancelFunc()
+		if err != nil {
+			if ctx.Err() == nil {
+				d.options.logErrorFunc("watchService", "serviceName", serviceName, "err", err)
+				sleep(ctx, time.Second)
+			}
+			continue
+		}
+		events := registry.Diff(
+			map[string][]*registry.Node{serviceName: nodes},
+			map[string][]*registry.Node{serviceName: newNodes},
+		)
+		for _, event := range events {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		nodes, index = newNodes, resetIndex(index, newIndex)
+		if len(nodes) <= 0 && stopIfGone(serviceName) {
+			return
+		}
+	}
+}
+
+func (d *_DiscoveryRegistry) serviceNames(ctx context.Context, index uint64) ([]string, uint64, error) {
+	var serviceNameMapTags map[string][]string
+	index, err := d.do(ctx, http.MethodGet, "/v1/catalog/services", d.blockingQuery(index), nil, &serviceNameMapTags)
+	if err != nil {
+		return nil, 0, err
+	}
+	var serviceNames []string
+	for serviceName, tags := range serviceNameMapTags {
+		for _, tag := range tags {
+			if tag == d.options.tag {
+				serviceNames = append(serviceNames, serviceName)
+				break
+			}
+		}
+	}
+	return serviceNames, index, nil
+}
+
+func (d *_DiscoveryRegistry) healthyNodes(ctx context.Context, serviceName string, index uint64) ([]*registry.Node, uint64, error) {
+	query := d.blockingQuery(index)
+	query.Set("tag", d.options.tag)
+	query.Set("passing", "true")
+	var entries []*_ServiceEntry
+	index, err := d.do(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(serviceName), query, nil, &entries)
+	if err != nil {
+		return nil, 0, err
+	}
+	nodes := make([]*registry.Node, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		metadata, err := base64.StdEncoding.DecodeString(entry.Service.Meta[metaKeyMetadata])
+		if err != nil {
+			d.options.logErrorFunc("healthyNodes", "serviceName", serviceName, "entry", entry, "err", err)
+			continue
+		}
+		nodes = append(nodes, &registry.Node{
+			ServiceName: serviceName,
+			Addr:        net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)),
+			Metadata:    metadata,
+		})
+	}
+	return nodes, index, nil
+}
+
+func (d *_DiscoveryRegistry) blockingQuery(index uint64) url.Values {
+	query := make(url.Values)
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%dms", d.options.waitTime.Milliseconds()))
+	}
+	return query
+}
+
+func (d *_DiscoveryRegistry) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (uint64, error) {
+	var body io.Reader
+	if in != nil {
+		bs, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(bs)
+	}
+	rawURL := d.addr + path
+	if len(query) > 0 {
+		rawURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return 0, err
+	}
+	if d.options.token != "" {
+		req.Header.Set("X-Consul-Token", d.options.token)
+	}
+	rsp, err := d.options.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return 0, errNotFound
+	}
+	if rsp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(rsp.Body)
+		return 0, fmt.Errorf("consul: %v %v status:%v body:%v", method, path, rsp.StatusCode, string(bs))
+	}
+	if out != nil {
+		if err := json.NewDecoder(rsp.Body).Decode(out); err != nil {
+			return 0, err
+		}
+	}
+	index, _ := strconv.ParseUint(rsp.Header.Get("X-Consul-Index"), 10, 64)
+	return index, nil
+}
+
+func toSet(serviceNames []string) map[string]bool {
+	set := make(map[string]bool, len(serviceNames))
+	for _, serviceName := range serviceNames {
+		set[serviceName] = true
+	}
+	return set
+}
+
+func toServiceID(node *registry.Node) string {
+	return node.ServiceName + "-" + node.Addr
+}
+
+func toCheckID(serviceID string) string {
+	return "service:" + serviceID
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// resetIndex follows consul's blocking query rules, an index that goes backwards restarts from 0
+func resetIndex(index, newIndex uint64) uint64 {
+	if newIndex < index {
+		return 0
+	}
+	return newIndex
+}
@@ -0,0 +1,333 @@
+package consul
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+type (
+	// _FakeAgent speaks the part of the consul agent http api the registry uses, with blocking queries
+	_FakeAgent struct {
+		mutex                    sync.Mutex
+		index                    uint64
+		changedCh                chan struct{} // closed and replaced on every change
+		serviceIDMapRegistration map[string]*_AgentServiceRegistration
+		checkIDMapPassing        map[string]bool
+		checkIDMapPasses         map[string]int
+	}
+)
+
+func newFakeAgent(t *testing.T) (*_FakeAgent, string) {
+	f := &_FakeAgent{
+		index:                    1,
+		changedCh:                make(chan struct{}),
+		serviceIDMapRegistration: make(map[string]*_AgentServiceRegistration),
+		checkIDMapPassing:        make(map[string]bool),
+		checkIDMapPasses:         make(map[string]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *_FakeAgent) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case r.Method == http.MethodPut && path == "/v1/agent/service/register":
+		reg := new(_AgentServiceRegistration)
+		if err := json.NewDecoder(r.Body).Decode(reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.update(func() {
+			f.serviceIDMapRegistration[reg.ID] = reg
+			f.checkIDMapPassing[reg.Check.CheckID] = f.checkIDMapPassing[reg.Check.CheckID] // a registered check keeps its status
+		})
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/v1/agent/check/pass/"):
+		checkID := strings.TrimPrefix(path, "/v1/agent/check/pass/")
+		f.mutex.Lock()
+		_, ok := f.checkIDMapPassing[checkID]
+		f.mutex.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.update(func() {
+			f.checkIDMapPassing[checkID] = true
+			f.checkIDMapPasses[checkID]++
+		})
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/v1/agent/service/deregister/"):
+		serviceID := strings.TrimPrefix(path, "/v1/agent/service/deregister/")
+		f.update(func() {
+			f.remove(serviceID)
+		})
+	case r.Method == http.MethodGet && path == "/v1/catalog/services":
+		f.serveBlocking(w, r, func() interface{} {
+			serviceNameMapTags := make(map[string][]string)
+			for _, reg := range f.serviceIDMapRegistration {
+				serviceNameMapTags[reg.Name] = reg.Tags
+			}
+			return serviceNameMapTags
+		})
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/v1/health/service/"):
+		serviceName, tag := strings.TrimPrefix(path, "/v1/health/service/"), r.URL.Query().Get("tag")
+		f.serveBlocking(w, r, func() interface{} {
+			entries := make([]*_ServiceEntry, 0)
+			for _, reg := range f.serviceIDMapRegistration {
+				if reg.Name != serviceName || len(reg.Tags) <= 0 || reg.Tags[0] != tag || !f.checkIDMapPassing[reg.Check.CheckID] {
+					continue
+				}
+				entry := new(_ServiceEntry)
+				entry.Node.Address = "10.0.0.1"
+				entry.Service.Service, entry.Service.Address, entry.Service.Port, entry.Service.Meta = reg.Name, reg.Address, reg.Port, reg.Meta
+				entries = append(entries, entry)
+			}
+			return entries
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveBlocking waits while the index of the request is current, up to wait
+func (f *_FakeAgent) serveBlocking(w http.ResponseWriter, r *http.Request, result func() interface{}) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		f.mutex.Lock()
+		if index < f.index || wait <= 0 {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+			bs, _ := json.Marshal(result())
+			f.mutex.Unlock()
+			_, _ = w.Write(bs)
+			return
+		}
+		changedCh := f.changedCh
+		f.mutex.Unlock()
+		select {
+		case <-changedCh:
+		case <-timer.C:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *_FakeAgent) update(change func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	change()
+	f.index++
+	close(f.changedCh)
+	f.changedCh = make(chan struct{})
+}
+
+// remove must be called under update
+func (f *_FakeAgent) remove(serviceID string) {
+	if reg, ok := f.serviceIDMapRegistration[serviceID]; ok {
+		delete(f.checkIDMapPassing, reg.Check.CheckID)
+		delete(f.serviceIDMapRegistration, serviceID)
+	}
+}
+
+func (f *_FakeAgent) registration(serviceID string) *_AgentServiceRegistration {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.serviceIDMapRegistration[serviceID]
+}
+
+func (f *_FakeAgent) passes(serviceID string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.checkIDMapPasses[toCheckID(serviceID)]
+}
+
+func newTestRegistry(t *testing.T, addr string, opts ...Option) *_DiscoveryRegistry {
+	return New(addr, append([]Option{
+		WithIntervalAndTTL(time.Millisecond*20, time.Millisecond*60),
+		WithWaitTime(time.Second),
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {
+			t.Log(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		}),
+	}, opts...)...)
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event) *registry.Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second * 3):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 3); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timeout waiting for %v", what)
+}
+
+func TestRegister(t *testing.T) {
+	agent, addr := newFakeAgent(t)
+	d := newTestRegistry(t, addr)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: []byte(`{"zone":"a"}`)}
+	serviceID := toServiceID(node)
+	deregisterFunc, err := d.Register(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := agent.registration(serviceID)
+	if reg == nil || reg.Name != node.ServiceName || reg.Address != "10.0.0.10" || reg.Port != 8080 || reg.Tags[0] != "micro" {
+		t.Fatalf("got %+v, want %v registered with tag micro", reg, node)
+	}
+	if reg.Check.TTL != "60ms" || reg.Check.DeregisterCriticalServiceAfter != "1m0s" {
+		t.Fatalf("got %+v, want a ttl check of 60ms", reg.Check)
+	}
+	if metadata, _ := base64.StdEncoding.DecodeString(reg.Meta[metaKeyMetadata]); string(metadata) != string(node.Metadata) {
+		t.Fatalf("got %q, want %q", metadata, node.Metadata)
+	}
+	waitFor(t, "the ttl check passed by keepalive", func() bool {
+		return agent.passes(serviceID) >= 3
+	})
+
+	// the agent lost the service, e.g. it restarted, keepalive registers it again
+	agent.update(func() {
+		agent.remove(serviceID)
+	})
+	waitFor(t, "the service registered again", func() bool {
+		return agent.registration(serviceID) != nil
+	})
+
+	deregisterFunc()
+	if agent.registration(serviceID) != nil {
+		t.Fatalf("got %v still registered, want it deregistered", serviceID)
+	}
+	passes := agent.passes(serviceID)
+	time.Sleep(time.Millisecond * 100)
+	if got := agent.passes(serviceID); got != passes {
+		t.Fatalf("got %v passes, want %v, keepalive must stop after deregister", got, passes)
+	}
+}
+
+func TestRegisterReplaced(t *testing.T) {
+	agent, addr := newFakeAgent(t)
+	d := newTestRegistry(t, addr)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	deregisterFunc, err := d.Register(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deregisterFunc()
+	updatedDeregisterFunc, err := d.Register(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: []byte(`{"zone":"a"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deregisterFunc()
+	if agent.registration(toServiceID(node)) == nil {
+		t.Fatal("got the service deregistered, want the later Register to own it")
+	}
+	updatedDeregisterFunc()
+	if agent.registration(toServiceID(node)) != nil {
+		t.Fatal("got the service registered, want it deregistered")
+	}
+}
+
+func TestWatchAndGet(t *testing.T) {
+	_, addr := newFakeAgent(t)
+	d := newTestRegistry(t, addr)
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	deregisterFunc, err := d.Register(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deregisterFunc()
+	otherTagDeregisterFunc, err := newTestRegistry(t, addr, WithTag("other")).Register(&registry.Node{ServiceName: "other.Other", Addr: "10.0.0.20:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherTagDeregisterFunc()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serviceNameMapNodes) != 1 || len(serviceNameMapNodes["echo.Echo"]) != 1 || serviceNameMapNodes["echo.Echo"][0].Addr != node.Addr {
+		t.Fatalf("got %v, want only %v of tag micro", serviceNameMapNodes, node)
+	}
+
+	newNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"}
+	newDeregisterFunc, err := d.Register(newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDeregisterFunc()
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != newNode.Addr {
+		t.Fatalf("got %v, want create of %v", event, newNode)
+	}
+	updatedNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080", Metadata: []byte(`{"zone":"a"}`)}
+	updatedDeregisterFunc, err := d.Register(updatedNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updatedDeregisterFunc()
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeUpdate || string(event.Node.Metadata) != string(updatedNode.Metadata) {
+		t.Fatalf("got %v, want update of %v", event, updatedNode)
+	}
+	newDeregisterFunc() // replaced by updatedNode, the node stays
+	updatedDeregisterFunc()
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeDelete || event.Node.Addr != newNode.Addr {
+		t.Fatalf("got %v, want delete of %v", event, newNode)
+	}
+
+	cancelFunc()
+	for range eventCh {
+	}
+}
+
+func TestServiceRemoval(t *testing.T) {
+	_, addr := newFakeAgent(t)
+	d := newTestRegistry(t, addr)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serviceNameMapNodes) != 0 {
+		t.Fatalf("got %v, want no service", serviceNameMapNodes)
+	}
+
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	// the service comes, goes with its last node, and comes back, it is watched again every time
+	for i := 0; i < 2; i++ {
+		deregisterFunc, err := d.Register(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != node.Addr {
+			t.Fatalf("got %v, want create of %v", event, node)
+		}
+		deregisterFunc()
+		if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeDelete || event.Node.Addr != node.Addr {
+			t.Fatalf("got %v, want delete of %v", event, node)
+		}
+	}
+}
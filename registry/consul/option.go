@@ -0,0 +1,83 @@
+package consul
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+type (
+	_Options struct {
+		tag                            string
+		token                          string
+		httpClient                     *http.Client
+		interval                       time.Duration
+		ttl                            time.Duration
+		deregisterCriticalServiceAfter time.Duration
+		waitTime                       time.Duration
+		logErrorFunc                   func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		tag:                            "micro",
+		httpClient:                     http.DefaultClient,
+		interval:                       time.Second * 5,
+		deregisterCriticalServiceAfter: time.Minute,
+		waitTime:                       time.Minute,
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	o.ttl = o.interval * 3
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithTag marks registered services, discovery only sees services with this tag
+func WithTag(tag string) Option {
+	return func(o *_Options) {
+		o.tag = tag
+	}
+}
+
+func WithToken(token string) Option {
+	return func(o *_Options) {
+		o.token = token
+	}
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *_Options) {
+		o.httpClient = httpClient
+	}
+}
+
+func WithIntervalAndTTL(interval, ttl time.Duration) Option {
+	return func(o *_Options) {
+		o.interval = interval
+		o.ttl = ttl
+	}
+}
+
+func WithDeregisterCriticalServiceAfter(deregisterCriticalServiceAfter time.Duration) Option {
+	return func(o *_Options) {
+		o.deregisterCriticalServiceAfter = deregisterCriticalServiceAfter
+	}
+}
+
+func WithWaitTime(waitTime time.Duration) Option {
+	return func(o *_Options) {
+		o.waitTime = waitTime
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
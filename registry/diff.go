@@ -0,0 +1,38 @@
+package registry
+
+import (
+	"bytes"
+)
+
+func Diff(oldServiceNameMapNodes, newServiceNameMapNodes map[string][]*Node) []*Event {
+	var events []*Event
+	for serviceName, newNodes := range newServiceNameMapNodes {
+		oldAddrMapNode := addrMapNode(oldServiceNameMapNodes[serviceName])
+		for _, newNode := range newNodes {
+			oldNode, ok := oldAddrMapNode[newNode.Addr]
+			switch {
+			case !ok:
+				events = append(events, &Event{Type: NodeEventTypeCreate, Node: newNode})
+			case !bytes.Equal(oldNode.Metadata, newNode.Metadata):
+				events = append(events, &Event{Type: NodeEventTypeUpdate, Node: newNode})
+			}
+		}
+	}
+	for serviceName, oldNodes := range oldServiceNameMapNodes {
+		newAddrMapNode := addrMapNode(newServiceNameMapNodes[serviceName])
+		for _, oldNode := range oldNodes {
+			if _, ok := newAddrMapNode[oldNode.Addr]; !ok {
+				events = append(events, &Event{Type: NodeEventTypeDelete, Node: oldNode})
+			}
+		}
+	}
+	return events
+}
+
+func addrMapNode(nodes []*Node) map[string]*Node {
+	m := make(map[string]*Node, len(nodes))
+	for _, node := range nodes {
+		m[node.Addr] = node
+	}
+	return m
+}
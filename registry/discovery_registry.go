@@ -1,5 +1,10 @@
 package registry
 
+import (
+	"context"
+	"sync/atomic"
+)
+
 const (
 	NodeEventTypeCreate nodeEventType = "create"
 	NodeEventTypeUpdate nodeEventType = "update"
@@ -10,7 +15,9 @@ type (
 	Node struct {
 		ServiceName string
 		Addr        string
-		Metadata    []byte
+		Metadata    []byte // see EncodeMetadata
+
+		decoded atomic.Value // *_DecodedMetadata, see Meta
 	}
 	nodeEventType string
 	Event         struct {
@@ -20,6 +27,11 @@ type (
 	Discovery interface {
 		WatchAndGet() (<-chan *Event, map[string][]*Node, error)
 	}
+	// ContextDiscovery is optionally implemented by a Discovery that can stop watching,
+	// it stops when ctx is done, then closes the event channel
+	ContextDiscovery interface {
+		WatchAndGetContext(ctx context.Context) (<-chan *Event, map[string][]*Node, error)
+	}
 	Registry interface {
 		Register(node *Node) (deregisterFunc func(), err error)
 	}
@@ -27,4 +39,92 @@ type (
 		Discovery
 		Registry
 	}
+	// Config is optionally implemented by a backend to hold configs that operators change centrally,
+	// the channel first gets the current value, then every change, nil means the key is absent
+	Config interface {
+		WatchConfig(key string) (<-chan []byte, error)
+	}
+	// ContextConfig is optionally implemented by a Config that can stop watching, the channel is closed when ctx is done
+	ContextConfig interface {
+		WatchConfigContext(ctx context.Context, key string) (<-chan []byte, error)
+	}
 )
+
+// WatchAndGet the event channel is closed when ctx is done, a Discovery that is not a ContextDiscovery
+// keeps watching, its events are dropped
+func WatchAndGet(ctx context.Context, discovery Discovery) (<-chan *Event, map[string][]*Node, error) {
+	if contextDiscovery, ok := discovery.(ContextDiscovery); ok {
+		return contextDiscovery.WatchAndGetContext(ctx)
+	}
+	watchCh, serviceNameMapNodes, err := discovery.WatchAndGet()
+	if err != nil {
+		return nil, nil, err
+	}
+	eventCh := make(chan *Event, 1)
+	go func() {
+		defer close(eventCh)
+		for {
+			select {
+			case event, ok := <-watchCh:
+				if !ok {
+					return
+				}
+				select {
+				case eventCh <- event:
+				case <-ctx.Done():
+					go drainEvents(watchCh)
+					return
+				}
+			case <-ctx.Done():
+				go drainEvents(watchCh)
+				return
+			}
+		}
+	}()
+	return eventCh, serviceNameMapNodes, nil
+}
+
+// WatchConfig the channel is closed when ctx is done, a Config that is not a ContextConfig keeps watching,
+// its values are dropped
+func WatchConfig(ctx context.Context, config Config, key string) (<-chan []byte, error) {
+	if contextConfig, ok := config.(ContextConfig); ok {
+		return contextConfig.WatchConfigContext(ctx, key)
+	}
+	watchCh, err := config.WatchConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	configCh := make(chan []byte, 1)
+	go func() {
+		defer close(configCh)
+		for {
+			select {
+			case value, ok := <-watchCh:
+				if !ok {
+					return
+				}
+				select {
+				case configCh <- value:
+				case <-ctx.Done():
+					go drainConfigs(watchCh)
+					return
+				}
+			case <-ctx.Done():
+				go drainConfigs(watchCh)
+				return
+			}
+		}
+	}()
+	return configCh, nil
+}
+
+// drainEvents keeps a watch that can not be stopped from blocking on a channel nobody reads
+func drainEvents(eventCh <-chan *Event) {
+	for range eventCh {
+	}
+}
+
+func drainConfigs(configCh <-chan []byte) {
+	for range configCh {
+	}
+}
@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"context"
+	"github.com/go-productive/micro"
+	"github.com/go-productive/micro/registry"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	_Discovery struct {
+		targets []Target
+		options *_Options
+	}
+	Target struct {
+		ServiceName string // grpc service name, e.g. echo.Echo
+		Name        string // dns name, SRV records are looked up first
+		Port        int    // port for A/AAAA records when Name has no SRV records
+	}
+)
+
+func New(targets []Target, opts ...Option) *_Discovery {
+	return &_Discovery{
+		targets: targets,
+		options: newOptions(opts),
+	}
+}
+
+func (d *_Discovery) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_Discovery) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	targetNodes := make([][]*registry.Node, len(d.targets))
+	for i, target := range d.targets {
+		nodes, err := d.resolve(ctx, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		targetNodes[i] = nodes
+	}
+	eventChan := make(chan *registry.Event, 1)
+	go d.watch(ctx, targetNodes, eventChan)
+	return eventChan, toServiceNameMapNodes(targetNodes), nil
+}
+
+func (d *_Discovery) watch(ctx context.Context, targetNodes [][]*registry.Node, eventCh chan<- *registry.Event) {
+	defer close(eventCh)
+	ticker := time.NewTicker(d.options.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		newTargetNodes := make([][]*registry.Node, len(d.targets))
+		for i, target := range d.targets {
+			nodes, err := d.resolve(ctx, target)
+			if err != nil {
+				d.options.logErrorFunc("watch", "target", target, "err", err)
+				nodes = targetNodes[i] // keep the last known nodes rather than deleting them on a dns hiccup
+			}
+			newTargetNodes[i] = nodes
+		}
+		if ctx.Err() != nil { // resolving was cancelled, the kept nodes are not news
+			return
+		}
+		for _, event := range registry.Diff(toServiceNameMapNodes(targetNodes), toServiceNameMapNodes(newTargetNodes)) {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		targetNodes = newTargetNodes
+	}
+}
+
+func (d *_Discovery) resolve(ctx context.Context, target Target) ([]*registry.Node, error) {
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+	defer cancelFunc()
+	var nodes []*registry.Node
+	_, srvs, err := d.options.resolver.LookupSRV(timeout, "", "", target.Name)
+	if err != nil && !isNotFound(err) { // not a missing SRV record, falling back to A/AAAA would guess the port
+		return nil, err
+	}
+	if len(srvs) > 0 {
+		for _, srv := range srvs {
+			nodes = append(nodes, &registry.Node{
+				ServiceName: target.ServiceName,
+				Addr:        net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))),
+			})
+		}
+		return nodes, nil
+	}
+	ipAddrs, err := d.options.resolver.LookupIPAddr(timeout, target.Name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ipAddr := range ipAddrs {
+		nodes = append(nodes, &registry.Node{
+			ServiceName: target.ServiceName,
+			Addr:        net.JoinHostPort(ipAddr.IP.String(), strconv.Itoa(target.Port)),
+		})
+	}
+	return nodes, nil
+}
+
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+func toServiceNameMapNodes(targetNodes [][]*registry.Node) map[string][]*registry.Node {
+	serviceNameMapNodes := make(map[string][]*registry.Node)
+	for _, nodes := range targetNodes {
+		for _, node := range nodes {
+			serviceNameMapNodes[node.ServiceName] = append(serviceNameMapNodes[node.ServiceName], node)
+		}
+	}
+	return serviceNameMapNodes
+}
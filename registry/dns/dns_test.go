@@ -0,0 +1,257 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+const (
+	typeA   = 1
+	typeSRV = 33
+
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+)
+
+type (
+	// _FakeServer answers A and SRV questions over udp from in-memory records
+	_FakeServer struct {
+		conn net.PacketConn
+
+		mutex       sync.Mutex
+		srvServFail bool // answers SRV questions with SERVFAIL
+		srvs        map[string][]*net.SRV
+		ips         map[string][]net.IP
+	}
+)
+
+func newFakeServer(t *testing.T) *_FakeServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &_FakeServer{
+		conn: conn,
+		srvs: make(map[string][]*net.SRV),
+		ips:  make(map[string][]net.IP),
+	}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s
+}
+
+func (s *_FakeServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+func (s *_FakeServer) set(fn func(s *_FakeServer)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn(s)
+}
+
+func (s *_FakeServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if rsp := s.answer(buf[:n]); rsp != nil {
+			_, _ = s.conn.WriteTo(rsp, addr)
+		}
+	}
+}
+
+func (s *_FakeServer) answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	end := 12
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		labels = append(labels, string(query[end+1:end+1+int(query[end])]))
+		end += 1 + int(query[end])
+	}
+	end += 5 // root label, qtype and qclass
+	if end > len(query) {
+		return nil
+	}
+	name, qtype := strings.ToLower(strings.Join(labels, ".")+"."), binary.BigEndian.Uint16(query[end-4:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var rcode uint16
+	var answers [][]byte
+	switch {
+	case s.srvServFail && qtype == typeSRV:
+		rcode = rcodeServFail
+	case s.srvs[name] == nil && s.ips[name] == nil:
+		rcode = rcodeNXDomain
+	case qtype == typeSRV:
+		for _, srv := range s.srvs[name] {
+			rdata := make([]byte, 6)
+			binary.BigEndian.PutUint16(rdata, srv.Priority)
+			binary.BigEndian.PutUint16(rdata[2:], srv.Weight)
+			binary.BigEndian.PutUint16(rdata[4:], srv.Port)
+			answers = append(answers, encodeRecord(typeSRV, append(rdata, encodeName(srv.Target)...)))
+		}
+	case qtype == typeA:
+		for _, ip := range s.ips[name] {
+			answers = append(answers, encodeRecord(typeA, ip.To4()))
+		}
+	}
+
+	rsp := make([]byte, 12, 512)
+	copy(rsp, query[:2])                              // id
+	binary.BigEndian.PutUint16(rsp[2:], 0x8480|rcode) // response, authoritative, recursion available
+	binary.BigEndian.PutUint16(rsp[4:], 1)            // question count
+	binary.BigEndian.PutUint16(rsp[6:], uint16(len(answers)))
+	rsp = append(rsp, query[12:end]...)
+	for _, answer := range answers {
+		rsp = append(rsp, answer...)
+	}
+	return rsp
+}
+
+// encodeRecord points the record name to the question name at offset 12
+func encodeRecord(rtype uint16, rdata []byte) []byte {
+	record := make([]byte, 12, 12+len(rdata))
+	binary.BigEndian.PutUint16(record, 0xc00c)
+	binary.BigEndian.PutUint16(record[2:], rtype)
+	binary.BigEndian.PutUint16(record[4:], 1) // class IN
+	binary.BigEndian.PutUint32(record[6:], 60)
+	binary.BigEndian.PutUint16(record[10:], uint16(len(rdata)))
+	return append(record, rdata...)
+}
+
+func encodeName(name string) []byte {
+	var bs []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		bs = append(bs, byte(len(label)))
+		bs = append(bs, label...)
+	}
+	return append(bs, 0)
+}
+
+func toAddrs(nodes []*registry.Node) []string {
+	addrs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		addrs = append(addrs, node.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestSRV(t *testing.T) {
+	s := newFakeServer(t)
+	s.set(func(s *_FakeServer) {
+		s.srvs["_grpc._tcp.echo.test."] = []*net.SRV{
+			{Target: "node1.test.", Port: 8080, Weight: 1},
+			{Target: "node2.test.", Port: 8081, Weight: 1},
+		}
+	})
+	d := New([]Target{{ServiceName: "echo.Echo", Name: "_grpc._tcp.echo.test.", Port: 9090}}, WithResolver(s.resolver()))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	_, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := toAddrs(serviceNameMapNodes["echo.Echo"]); strings.Join(addrs, ",") != "node1.test:8080,node2.test:8081" {
+		t.Fatalf("got %v, want the SRV targets", addrs)
+	}
+}
+
+func TestFallbackToA(t *testing.T) {
+	s := newFakeServer(t)
+	s.set(func(s *_FakeServer) {
+		s.ips["echo.test."] = []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.11")}
+	})
+	d := New([]Target{{ServiceName: "echo.Echo", Name: "echo.test.", Port: 8080}}, WithResolver(s.resolver()))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	_, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := toAddrs(serviceNameMapNodes["echo.Echo"]); strings.Join(addrs, ",") != "10.0.0.10:8080,10.0.0.11:8080" {
+		t.Fatalf("got %v, want the A records with Target.Port", addrs)
+	}
+}
+
+func TestNoFallbackOnSRVError(t *testing.T) {
+	s := newFakeServer(t)
+	s.set(func(s *_FakeServer) {
+		s.ips["echo.test."] = []net.IP{net.ParseIP("10.0.0.10")}
+		s.srvServFail = true
+	})
+	d := New([]Target{{ServiceName: "echo.Echo", Name: "echo.test.", Port: 8080}}, WithResolver(s.resolver()))
+	if _, _, err := d.WatchAndGet(); err == nil {
+		t.Fatal("got nil error, want the SRV lookup error")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := newFakeServer(t)
+	s.set(func(s *_FakeServer) {
+		s.srvs["echo.test."] = []*net.SRV{{Target: "node1.test.", Port: 8080}}
+	})
+	d := New([]Target{{ServiceName: "echo.Echo", Name: "echo.test."}},
+		WithResolver(s.resolver()),
+		WithInterval(time.Millisecond*20),
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {}),
+	)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, _, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dns hiccup keeps the last known nodes
+	s.set(func(s *_FakeServer) {
+		s.srvServFail = true
+	})
+	select {
+	case event := <-eventCh:
+		t.Fatalf("got %v, want no event while the server fails", event)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	s.set(func(s *_FakeServer) {
+		s.srvServFail = false
+		s.srvs["echo.test."] = []*net.SRV{{Target: "node2.test.", Port: 8080}}
+	})
+	typeMapAddr := make(map[string]string)
+	for len(typeMapAddr) < 2 {
+		select {
+		case event := <-eventCh:
+			typeMapAddr[string(event.Type)] = event.Node.Addr
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, want create and delete", typeMapAddr)
+		}
+	}
+	if typeMapAddr[string(registry.NodeEventTypeCreate)] != "node2.test:8080" || typeMapAddr[string(registry.NodeEventTypeDelete)] != "node1.test:8080" {
+		t.Fatalf("got %v, want node2 created and node1 deleted", typeMapAddr)
+	}
+
+	cancelFunc()
+	for range eventCh {
+	}
+}
@@ -0,0 +1,54 @@
+package dns
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+type (
+	Resolver interface {
+		LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+		LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	}
+	_Options struct {
+		interval     time.Duration
+		resolver     Resolver
+		logErrorFunc func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		interval: time.Second * 30,
+		resolver: net.DefaultResolver,
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithInterval(interval time.Duration) Option {
+	return func(o *_Options) {
+		o.interval = interval
+	}
+}
+
+// WithResolver replaces net.DefaultResolver, e.g. a *net.Resolver whose Dial points to another DNS server
+func WithResolver(resolver Resolver) Option {
+	return func(o *_Options) {
+		o.resolver = resolver
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
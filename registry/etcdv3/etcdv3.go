@@ -10,6 +10,7 @@ import (
 	"go.etcd.io/etcd/client/v3"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"sync"
 	"time"
 )
 
@@ -17,24 +18,37 @@ type (
 	_DiscoveryRegistry struct {
 		client  *clientv3.Client
 		options *_Options
+
+		registrationMutex  sync.Mutex
+		keyMapRegistration map[string]*_Registration
+	}
+	// _Registration stops the keepalive of a node once it is deregistered or replaced by a later Register
+	_Registration struct {
+		stopOnce sync.Once
+		stopCh   chan struct{}
 	}
 )
 
 func New(endpoints []string, opts ...Option) *_DiscoveryRegistry {
+	options := newOptions(opts)
+	dialOptions := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if options.blockingDial {
+		dialOptions = append(dialOptions, grpc.WithBlock())
+	}
 	client, err := clientv3.New(clientv3.Config{
 		Endpoints:   endpoints,
 		DialTimeout: micro.Timeout,
-		DialOptions: []grpc.DialOption{
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock(),
-		},
+		DialOptions: dialOptions,
 	})
 	if err != nil {
 		panic(err)
 	}
 	return &_DiscoveryRegistry{
-		client:  client,
-		options: newOptions(opts),
+		client:             client,
+		options:            options,
+		keyMapRegistration: make(map[string]*_Registration),
 	}
 }
 
@@ -43,13 +57,21 @@ func (d *_DiscoveryRegistry) Register(node *registry.Node) (func(), error) {
 	if err != nil {
 		return nil, err
 	}
-	deregisterNotifyChan := make(chan struct{})
+	key := d.toKey(node)
+	reg := &_Registration{stopCh: make(chan struct{})}
+	d.registrationMutex.Lock()
+	if replaced, ok := d.keyMapRegistration[key]; ok {
+		replaced.stop()
+	}
+	d.keyMapRegistration[key] = reg
+	d.registrationMutex.Unlock()
 	go func() {
 		ticker := time.NewTicker(d.options.interval)
 		defer ticker.Stop()
 		for {
 			select {
-			case <-deregisterNotifyChan:
+			case <-reg.stopCh:
+				d.revoke(grantRsp)
 				return
 			case <-ticker.C:
 				grantRsp = d.keepalive(node, grantRsp)
@@ -57,13 +79,37 @@ func (d *_DiscoveryRegistry) Register(node *registry.Node) (func(), error) {
 		}
 	}()
 	return func() {
-		close(deregisterNotifyChan)
+		d.registrationMutex.Lock()
+		current := d.keyMapRegistration[key] == reg
+		if current {
+			delete(d.keyMapRegistration, key)
+		}
+		d.registrationMutex.Unlock()
+		reg.stop()
+		if !current { // replaced by a later Register of the same node, which owns the key now
+			return
+		}
 		timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
 		defer cancelFunc()
-		_, _ = d.client.Delete(timeout, d.toKey(node))
+		_, _ = d.client.Delete(timeout, key)
 	}, nil
 }
 
+// revoke releases the lease of a stopped registration, the key stays if a later Register moved it to its own lease
+func (d *_DiscoveryRegistry) revoke(grantRsp *clientv3.LeaseGrantResponse) {
+	timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
+	defer cancelFunc()
+	if _, err := d.client.Revoke(timeout, grantRsp.ID); err != nil && err != rpctypes.ErrLeaseNotFound {
+		d.options.logErrorFunc("revoke", "err", err, "lease", grantRsp.ID)
+	}
+}
+
+func (r *_Registration) stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopCh)
+	})
+}
+
 func (d *_DiscoveryRegistry) renewGrant(node *registry.Node) (*clientv3.LeaseGrantResponse, error) {
 	key, value := d.toKey(node), string(node.Metadata)
 	timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
@@ -113,16 +159,26 @@ func (d *_DiscoveryRegistry) keepalive(node *registry.Node, grantRsp *clientv3.L
 }
 
 func (d *_DiscoveryRegistry) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
-	watchChan := d.client.Watch(context.TODO(), d.options.prefix, clientv3.WithPrefix())
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_DiscoveryRegistry) WatchAndGetContext(ctx context.Context) (_ <-chan *registry.Event, _ map[string][]*registry.Node, err error) {
+	watchCtx, watchCancelFunc := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			watchCancelFunc()
+		}
+	}()
+	watchChan := d.client.Watch(watchCtx, d.options.prefix, clientv3.WithPrefix())
 	eventChan := make(chan *registry.Event, 1)
 	go func() {
 		defer close(eventChan)
 		for watchRsp := range watchChan {
-			d.handleWatchRsp(&watchRsp, eventChan)
+			d.handleWatchRsp(watchCtx, &watchRsp, eventChan)
 		}
 	}()
 
-	timeout, cancelFunc := context.WithTimeout(context.TODO(), micro.Timeout)
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
 	defer cancelFunc()
 	rsp, err := d.client.Get(timeout, d.options.prefix, clientv3.WithPrefix())
 	if err != nil {
@@ -139,7 +195,7 @@ func (d *_DiscoveryRegistry) WatchAndGet() (<-chan *registry.Event, map[string][
 	return eventChan, serviceNameMapNodes, nil
 }
 
-func (d *_DiscoveryRegistry) handleWatchRsp(watchRsp *clientv3.WatchResponse, eventCh chan<- *registry.Event) {
+func (d *_DiscoveryRegistry) handleWatchRsp(ctx context.Context, watchRsp *clientv3.WatchResponse, eventCh chan<- *registry.Event) {
 	if watchRsp.Err() != nil {
 		d.options.logErrorFunc("handleWatchRsp", "err", watchRsp.Err(), "watchRsp", watchRsp)
 		return
@@ -162,6 +218,52 @@ func (d *_DiscoveryRegistry) handleWatchRsp(watchRsp *clientv3.WatchResponse, ev
 		case clientv3.EventTypeDelete:
 			event.Type = registry.NodeEventTypeDelete
 		}
-		eventCh <- event
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// WatchConfig key must not be under the prefix of nodes, e.g. /micro_config/traffic_policies
+func (d *_DiscoveryRegistry) WatchConfig(key string) (<-chan []byte, error) {
+	return d.WatchConfigContext(context.Background(), key)
+}
+
+func (d *_DiscoveryRegistry) WatchConfigContext(ctx context.Context, key string) (<-chan []byte, error) {
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+	defer cancelFunc()
+	rsp, err := d.client.Get(timeout, key)
+	if err != nil {
+		return nil, err
+	}
+	configChan := make(chan []byte, 1)
+	if len(rsp.Kvs) > 0 {
+		configChan <- rsp.Kvs[0].Value
+	} else {
+		configChan <- nil
 	}
+	watchChan := d.client.Watch(ctx, key, clientv3.WithRev(rsp.Header.Revision+1))
+	go func() {
+		defer close(configChan)
+		for watchRsp := range watchChan {
+			if watchRsp.Err() != nil {
+				d.options.logErrorFunc("WatchConfig", "key", key, "err", watchRsp.Err())
+				continue
+			}
+			for _, etcdEvent := range watchRsp.Events {
+				var value []byte
+				if etcdEvent.Type != clientv3.EventTypeDelete {
+					value = etcdEvent.Kv.Value
+				}
+				select {
+				case configChan <- value:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return configChan, nil
 }
@@ -10,6 +10,7 @@ type (
 		prefix       string
 		interval     time.Duration
 		ttl          time.Duration
+		blockingDial bool
 		logErrorFunc func(msg string, keysAndValues ...interface{})
 	}
 	Option func(*_Options)
@@ -17,8 +18,9 @@ type (
 
 func newOptions(opts []Option) *_Options {
 	o := &_Options{
-		prefix:   "/services",
-		interval: time.Second * 5,
+		prefix:       "/services",
+		interval:     time.Second * 5,
+		blockingDial: true,
 		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
 			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
 		},
@@ -48,3 +50,10 @@ func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{}
 		o.logErrorFunc = logErrorFunc
 	}
 }
+
+// WithNonBlockingDial makes New return without waiting for etcd, e.g. to serve a cached snapshot while etcd is down
+func WithNonBlockingDial() Option {
+	return func(o *_Options) {
+		o.blockingDial = false
+	}
+}
@@ -0,0 +1,127 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-productive/micro/registry"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	_Discovery struct {
+		path    string
+		options *_Options
+	}
+	// _Entry is one node in the file, the file maps service name to its entries:
+	//
+	//	echo.Echo:
+	//	  - addr: 10.0.0.1:64000
+	//	    metadata: v1
+	_Entry struct {
+		Addr     string `json:"addr" yaml:"addr"`
+		Metadata string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	}
+)
+
+var (
+	errEmptyFile = errors.New("empty file")
+)
+
+func New(path string, opts ...Option) *_Discovery {
+	return &_Discovery{
+		path:    path,
+		options: newOptions(opts),
+	}
+}
+
+func (d *_Discovery) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_Discovery) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	content, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	serviceNameMapNodes, err := d.decode(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	eventChan := make(chan *registry.Event, 1)
+	go d.watch(ctx, content, serviceNameMapNodes, eventChan)
+	return eventChan, serviceNameMapNodes, nil
+}
+
+func (d *_Discovery) watch(ctx context.Context, content []byte, serviceNameMapNodes map[string][]*registry.Node, eventCh chan<- *registry.Event) {
+	defer close(eventCh)
+	ticker := time.NewTicker(d.options.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		newContent, err := ioutil.ReadFile(d.path)
+		if err != nil {
+			d.options.logErrorFunc("watch", "path", d.path, "err", err)
+			continue
+		}
+		if bytes.Equal(content, newContent) {
+			continue
+		}
+		// an empty or broken file is most likely caught in the middle of a write, keep the previous nodes until it is complete
+		if len(bytes.TrimSpace(newContent)) <= 0 {
+			d.options.logErrorFunc("watch", "path", d.path, "err", errEmptyFile)
+			continue
+		}
+		newServiceNameMapNodes, err := d.decode(newContent)
+		if err != nil {
+			d.options.logErrorFunc("watch", "path", d.path, "err", err)
+			continue
+		}
+		for _, event := range registry.Diff(serviceNameMapNodes, newServiceNameMapNodes) {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+		content, serviceNameMapNodes = newContent, newServiceNameMapNodes
+	}
+}
+
+func (d *_Discovery) decode(content []byte) (map[string][]*registry.Node, error) {
+	var serviceNameMapEntries map[string][]*_Entry
+	var err error
+	switch strings.ToLower(filepath.Ext(d.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &serviceNameMapEntries)
+	default:
+		err = json.Unmarshal(content, &serviceNameMapEntries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serviceNameMapNodes := make(map[string][]*registry.Node, len(serviceNameMapEntries))
+	for serviceName, entries := range serviceNameMapEntries {
+		for _, entry := range entries {
+			if entry == nil || entry.Addr == "" {
+				return nil, fmt.Errorf("service:%v has entry without addr", serviceName)
+			}
+			serviceNameMapNodes[serviceName] = append(serviceNameMapNodes[serviceName], &registry.Node{
+				ServiceName: serviceName,
+				Addr:        entry.Addr,
+				Metadata:    []byte(entry.Metadata),
+			})
+		}
+	}
+	return serviceNameMapNodes, nil
+}
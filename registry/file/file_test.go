@@ -0,0 +1,128 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+type (
+	// _LogRecorder counts logged errors, so a test can wait until the watcher has seen a file
+	_LogRecorder struct {
+		mutex sync.Mutex
+		count int
+	}
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event) *registry.Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func newTestDiscovery(t *testing.T, path string) (<-chan *registry.Event, map[string][]*registry.Node, *_LogRecorder) {
+	t.Helper()
+	logRecorder := new(_LogRecorder)
+	d := New(path, WithInterval(time.Millisecond*10), WithLogErrorFunc(logRecorder.log))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		cancelFunc()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancelFunc()
+		for range eventCh {
+		}
+	})
+	return eventCh, serviceNameMapNodes, logRecorder
+}
+
+func (r *_LogRecorder) log(msg string, keysAndValues ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.count++
+}
+
+func (r *_LogRecorder) waitFor(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		r.mutex.Lock()
+		got := r.count
+		r.mutex.Unlock()
+		if got >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v logged errors, want %v", got, count)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.yaml")
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.10:8080\n")
+	eventCh, serviceNameMapNodes, _ := newTestDiscovery(t, path)
+	if nodes := serviceNameMapNodes["echo.Echo"]; len(nodes) != 1 || nodes[0].Addr != "10.0.0.10:8080" {
+		t.Fatalf("got %v, want 10.0.0.10:8080", nodes)
+	}
+
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.10:8080\n  - addr: 10.0.0.11:8080\n")
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != "10.0.0.11:8080" {
+		t.Fatalf("got %v, want create of 10.0.0.11:8080", event)
+	}
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.10:8080\n  - addr: 10.0.0.11:8080\n    metadata: v2\n")
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeUpdate || string(event.Node.Metadata) != "v2" {
+		t.Fatalf("got %v, want update of 10.0.0.11:8080", event)
+	}
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.11:8080\n    metadata: v2\n")
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeDelete || event.Node.Addr != "10.0.0.10:8080" {
+		t.Fatalf("got %v, want delete of 10.0.0.10:8080", event)
+	}
+}
+
+func TestKeepNodesOnBrokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodes.yaml")
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.10:8080\n")
+	eventCh, _, logRecorder := newTestDiscovery(t, path)
+
+	writeFile(t, path, "")
+	logRecorder.waitFor(t, 1)
+	writeFile(t, path, "echo.Echo:\n  - addr: [")
+	logRecorder.waitFor(t, 2)
+	select {
+	case event := <-eventCh:
+		t.Fatalf("got %v, want no event for an empty or broken file", event)
+	default:
+	}
+
+	// the nodes are diffed against the last good file, not against the broken one
+	writeFile(t, path, "echo.Echo:\n  - addr: 10.0.0.10:8080\n  - addr: 10.0.0.11:8080\n")
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node.Addr != "10.0.0.11:8080" {
+		t.Fatalf("got %v, want create of 10.0.0.11:8080", event)
+	}
+	select {
+	case event := <-eventCh:
+		t.Fatalf("got %v, want no more event", event)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,39 @@
+package file
+
+import (
+	"log"
+	"time"
+)
+
+type (
+	_Options struct {
+		interval     time.Duration
+		logErrorFunc func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		interval: time.Second * 5,
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithInterval(interval time.Duration) Option {
+	return func(o *_Options) {
+		o.interval = interval
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
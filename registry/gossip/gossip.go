@@ -0,0 +1,376 @@
+package gossip
+
+import (
+	"context"
+	"errors"
+	"github.com/go-productive/micro/registry"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	memberStateAlive   memberState = "alive"
+	memberStateSuspect memberState = "suspect"
+	memberStateDead    memberState = "dead"
+)
+
+var (
+	ErrClosed = errors.New("gossip: member is closed")
+)
+
+type (
+	memberState string
+	// _DiscoveryRegistry is a SWIM member, it probes other members over udp and piggybacks membership updates on
+	// probes, a periodic tcp push-pull of the full state makes members converge when udp updates are lost.
+	// Every member carries the registry nodes registered on it, so the nodes of all alive members are discovered.
+	_DiscoveryRegistry struct {
+		options  *_Options
+		self     string
+		udpConn  *net.UDPConn
+		listener net.Listener
+		closeCh  chan struct{}
+		loopWG   sync.WaitGroup
+
+		mutex               sync.Mutex
+		addrMapMember       map[string]*_Member
+		addrMapTransmits    map[string]int
+		probeQueue          []string
+		seqNo               uint64
+		seqNoMapAckFunc     map[uint64]func()
+		keyMapRegistration  map[string]*_Registration
+		serviceNameMapNodes map[string][]*registry.Node
+		watchers            []*_Watcher
+		closed              bool
+	}
+	_Member struct {
+		Addr        string           `json:"addr"`
+		Incarnation uint64           `json:"incarnation"`
+		State       memberState      `json:"state"`
+		Nodes       []*registry.Node `json:"nodes,omitempty"`
+
+		stateChangeTime time.Time
+	}
+	_Registration struct {
+		node *registry.Node
+	}
+	_Watcher struct {
+		mutex    sync.Mutex
+		events   []*registry.Event
+		notifyCh chan struct{}
+	}
+)
+
+func New(bindAddr string, opts ...Option) *_DiscoveryRegistry {
+	options := newOptions(opts)
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		panic(err)
+	}
+	tcpAddr := listener.Addr().(*net.TCPAddr)
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpAddr.IP, Port: tcpAddr.Port, Zone: tcpAddr.Zone})
+	if err != nil {
+		panic(err)
+	}
+	self := options.advertiseAddr
+	if self == "" {
+		if tcpAddr.IP.IsUnspecified() {
+			panic(errors.New("gossip: advertise addr is required when binding an unspecified ip"))
+		}
+		self = tcpAddr.String()
+	}
+	d := &_DiscoveryRegistry{
+		options:  options,
+		self:     self,
+		udpConn:  udpConn,
+		listener: listener,
+		closeCh:  make(chan struct{}),
+		addrMapMember: map[string]*_Member{
+			self: {
+				Addr:            self,
+				Incarnation:     uint64(time.Now().UnixNano()), // a restarted member must outrank what others remember of it
+				State:           memberStateAlive,
+				stateChangeTime: time.Now(),
+			},
+		},
+		addrMapTransmits:    make(map[string]int),
+		seqNoMapAckFunc:     make(map[uint64]func()),
+		keyMapRegistration:  make(map[string]*_Registration),
+		serviceNameMapNodes: make(map[string][]*registry.Node),
+	}
+	d.queueBroadcast(self)
+	d.loopWG.Add(4)
+	go d.serveUDP()
+	go d.serveTCP()
+	d.join()
+	go d.probeLoop()
+	go d.pushPullLoop()
+	return d
+}
+
+// Close leaves the cluster, it tells alive members that this member is dead, so they drop its nodes at once
+// instead of after the suspicion timeout, then stops probing and closes the udp conn and the tcp listener
+func (d *_DiscoveryRegistry) Close() error {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return ErrClosed
+	}
+	d.closed = true
+	self := d.addrMapMember[d.self]
+	leave := &_Member{
+		Addr:            d.self,
+		Incarnation:     self.Incarnation + 1,
+		State:           memberStateDead,
+		stateChangeTime: time.Now(),
+	}
+	d.addrMapMember[d.self] = leave
+	var addrs []string
+	for addr, member := range d.addrMapMember {
+		if addr != d.self && member.State != memberStateDead {
+			addrs = append(addrs, addr)
+		}
+	}
+	d.mutex.Unlock()
+	for _, addr := range addrs {
+		d.send(addr, &_Message{Type: messageTypeLeave, Members: []*_Member{leave}})
+	}
+
+	close(d.closeCh)
+	err := d.udpConn.Close()
+	if listenerErr := d.listener.Close(); err == nil {
+		err = listenerErr
+	}
+	d.loopWG.Wait()
+	d.options.logInfoFunc("close", "addr", d.self, "err", err)
+	return err
+}
+
+func (d *_DiscoveryRegistry) isClosed() bool {
+	select {
+	case <-d.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Addr is the advertised addr of this member, other members use it as a seed
+func (d *_DiscoveryRegistry) Addr() string {
+	return d.self
+}
+
+func (d *_DiscoveryRegistry) Register(node *registry.Node) (func(), error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil, ErrClosed
+	}
+	reg := &_Registration{node: node}
+	d.keyMapRegistration[toKey(node)] = reg
+	d.updateSelfNodes()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.deregister(reg)
+		})
+	}, nil
+}
+
+func (d *_DiscoveryRegistry) deregister(reg *_Registration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	key := toKey(reg.node)
+	if d.keyMapRegistration[key] != reg { // replaced by a later Register of the same node
+		return
+	}
+	delete(d.keyMapRegistration, key)
+	if d.closed { // the whole member already left
+		return
+	}
+	d.updateSelfNodes()
+}
+
+func (d *_DiscoveryRegistry) updateSelfNodes() {
+	self := d.addrMapMember[d.self]
+	nodes := make([]*registry.Node, 0, len(d.keyMapRegistration))
+	for _, reg := range d.keyMapRegistration {
+		nodes = append(nodes, reg.node)
+	}
+	d.addrMapMember[d.self] = &_Member{
+		Addr:            d.self,
+		Incarnation:     self.Incarnation + 1,
+		State:           memberStateAlive,
+		Nodes:           nodes,
+		stateChangeTime: time.Now(),
+	}
+	d.queueBroadcast(d.self)
+	d.refreshNodes()
+}
+
+func (d *_DiscoveryRegistry) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_DiscoveryRegistry) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	serviceNameMapNodes := make(map[string][]*registry.Node, len(d.serviceNameMapNodes))
+	for serviceName, nodes := range d.serviceNameMapNodes {
+		serviceNameMapNodes[serviceName] = append([]*registry.Node(nil), nodes...)
+	}
+	watcher := &_Watcher{
+		notifyCh: make(chan struct{}, 1),
+	}
+	d.watchers = append(d.watchers, watcher)
+	eventCh := make(chan *registry.Event, 1)
+	go func() {
+		watcher.loop(ctx, eventCh)
+		d.removeWatcher(watcher)
+		close(eventCh)
+	}()
+	return eventCh, serviceNameMapNodes, nil
+}
+
+func (d *_DiscoveryRegistry) removeWatcher(watcher *_Watcher) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	watchers := make([]*_Watcher, 0, len(d.watchers))
+	for _, w := range d.watchers {
+		if w != watcher {
+			watchers = append(watchers, w)
+		}
+	}
+	d.watchers = watchers
+}
+
+// refreshNodes recomputes the nodes of alive and suspect members, then notifies watchers of the difference
+func (d *_DiscoveryRegistry) refreshNodes() {
+	serviceNameMapNodes := make(map[string][]*registry.Node)
+	for _, member := range d.addrMapMember {
+		if member.State == memberStateDead {
+			continue
+		}
+		for _, node := range member.Nodes {
+			serviceNameMapNodes[node.ServiceName] = append(serviceNameMapNodes[node.ServiceName], node)
+		}
+	}
+	for _, event := range registry.Diff(d.serviceNameMapNodes, serviceNameMapNodes) {
+		for _, watcher := range d.watchers {
+			watcher.push(event)
+		}
+	}
+	d.serviceNameMapNodes = serviceNameMapNodes
+}
+
+// merge applies a membership update received from another member
+func (d *_DiscoveryRegistry) merge(update *_Member) {
+	if update.Addr == d.self {
+		self := d.addrMapMember[d.self]
+		if update.Incarnation > self.Incarnation || update.Incarnation == self.Incarnation && update.State != memberStateAlive {
+			refute := *self
+			refute.Incarnation = update.Incarnation + 1
+			d.addrMapMember[d.self] = &refute
+			d.queueBroadcast(d.self)
+			d.options.logInfoFunc("refute", "update", update, "incarnation", refute.Incarnation)
+		}
+		return
+	}
+	member, ok := d.addrMapMember[update.Addr]
+	switch {
+	case !ok && update.State == memberStateDead:
+		return
+	case ok && update.Incarnation < member.Incarnation:
+		return
+	case ok && update.Incarnation == member.Incarnation && statePriority(update.State) <= statePriority(member.State):
+		return
+	}
+	update.stateChangeTime = time.Now()
+	d.addrMapMember[update.Addr] = update
+	if !ok {
+		d.probeQueue = append(d.probeQueue, update.Addr)
+	}
+	if !ok || member.State != update.State {
+		d.options.logInfoFunc("memberState", "addr", update.Addr, "state", update.State, "incarnation", update.Incarnation)
+	}
+	d.queueBroadcast(update.Addr)
+	d.refreshNodes()
+}
+
+func (d *_DiscoveryRegistry) markState(addr string, state memberState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	member, ok := d.addrMapMember[addr]
+	if !ok || statePriority(member.State) >= statePriority(state) {
+		return
+	}
+	update := *member
+	update.State = state
+	d.merge(&update)
+}
+
+// reap turns suspects that did not refute in time into dead members, and forgets long dead members
+func (d *_DiscoveryRegistry) reap() {
+	d.mutex.Lock()
+	var suspects []string
+	for addr, member := range d.addrMapMember {
+		switch {
+		case member.State == memberStateSuspect && time.Since(member.stateChangeTime) > d.options.suspicionTimeout:
+			suspects = append(suspects, addr)
+		case member.State == memberStateDead && time.Since(member.stateChangeTime) > d.options.deadReclaimTime:
+			delete(d.addrMapMember, addr)
+			delete(d.addrMapTransmits, addr)
+		}
+	}
+	d.mutex.Unlock()
+	for _, addr := range suspects {
+		d.markState(addr, memberStateDead)
+	}
+}
+
+func (w *_Watcher) push(event *registry.Event) {
+	w.mutex.Lock()
+	w.events = append(w.events, event)
+	w.mutex.Unlock()
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *_Watcher) loop(ctx context.Context, eventCh chan<- *registry.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.notifyCh:
+		}
+		w.mutex.Lock()
+		events := w.events
+		w.events = nil
+		w.mutex.Unlock()
+		for _, event := range events {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func statePriority(state memberState) int {
+	switch state {
+	case memberStateAlive:
+		return 0
+	case memberStateSuspect:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func toKey(node *registry.Node) string {
+	return node.ServiceName + "/" + node.Addr
+}
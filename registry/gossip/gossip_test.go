@@ -0,0 +1,150 @@
+package gossip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func newTestMember(seeds ...string) *_DiscoveryRegistry {
+	return New("127.0.0.1:0",
+		WithSeeds(seeds...),
+		WithProbeIntervalAndTimeout(time.Millisecond*50, time.Millisecond*20),
+		WithSuspicionTimeout(time.Millisecond*200),
+		WithPushPullInterval(time.Hour), // converge by udp gossip alone, join is the only push-pull
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {}),
+		WithLogInfoFunc(func(msg string, keysAndValues ...interface{}) {}),
+	)
+}
+
+// stop cuts a member off the network as if its process died, unlike Close it does not tell the others
+func stop(d *_DiscoveryRegistry) {
+	close(d.closeCh)
+	_ = d.udpConn.Close()
+	_ = d.listener.Close()
+	d.loopWG.Wait()
+}
+
+func countNodes(d *_DiscoveryRegistry, serviceName string) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.serviceNameMapNodes[serviceName])
+}
+
+func waitNodes(t *testing.T, d *_DiscoveryRegistry, serviceName string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for countNodes(d, serviceName) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("member:%v got %v nodes, want %v", d.Addr(), countNodes(d, serviceName), want)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestConverge(t *testing.T) {
+	seed := newTestMember()
+	members := []*_DiscoveryRegistry{seed, newTestMember(seed.Addr()), newTestMember(seed.Addr())}
+	defer func() {
+		for _, member := range members {
+			_ = member.Close()
+		}
+	}()
+	var deregisterFuncs []func()
+	for i, member := range members {
+		deregisterFunc, err := member.Register(&registry.Node{ServiceName: "echo.Echo", Addr: member.Addr(), Metadata: []byte{byte(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deregisterFuncs = append(deregisterFuncs, deregisterFunc)
+	}
+	for _, member := range members {
+		waitNodes(t, member, "echo.Echo", len(members))
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, _, err := seed.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deregisterFuncs[2]()
+	select {
+	case event := <-eventCh:
+		if event.Type != registry.NodeEventTypeDelete || event.Node.Addr != members[2].Addr() {
+			t.Fatalf("got %v, want delete of %v", event, members[2].Addr())
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("deregister is not gossiped")
+	}
+	for _, member := range members {
+		waitNodes(t, member, "echo.Echo", len(members)-1)
+	}
+}
+
+func TestDeadMember(t *testing.T) {
+	seed := newTestMember()
+	members := []*_DiscoveryRegistry{seed, newTestMember(seed.Addr()), newTestMember(seed.Addr())}
+	defer func() {
+		for _, member := range members[:2] {
+			_ = member.Close()
+		}
+	}()
+	for _, member := range members {
+		if _, err := member.Register(&registry.Node{ServiceName: "echo.Echo", Addr: member.Addr()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, member := range members {
+		waitNodes(t, member, "echo.Echo", len(members))
+	}
+
+	stop(members[2])
+	for _, member := range members[:2] {
+		waitNodes(t, member, "echo.Echo", len(members)-1)
+	}
+	seed.mutex.Lock()
+	state := seed.addrMapMember[members[2].Addr()].State
+	seed.mutex.Unlock()
+	if state != memberStateDead {
+		t.Fatalf("got %v, want %v", state, memberStateDead)
+	}
+}
+
+func TestClose(t *testing.T) {
+	seed := newTestMember()
+	members := []*_DiscoveryRegistry{seed, newTestMember(seed.Addr()), newTestMember(seed.Addr())}
+	defer func() {
+		for _, member := range members[:2] {
+			_ = member.Close()
+		}
+	}()
+	for _, member := range members {
+		if _, err := member.Register(&registry.Node{ServiceName: "echo.Echo", Addr: member.Addr()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, member := range members {
+		waitNodes(t, member, "echo.Echo", len(members))
+	}
+
+	if err := members[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+	// a crashed member is only dropped after the suspicion timeout, a closed one well before it
+	start := time.Now()
+	for _, member := range members[:2] {
+		waitNodes(t, member, "echo.Echo", len(members)-1)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Millisecond*200 {
+		t.Fatalf("got %v, want the closed member dropped before the suspicion timeout", elapsed)
+	}
+	if err := members[2].Close(); err != ErrClosed {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+	if _, err := members[2].Register(&registry.Node{ServiceName: "echo.Echo", Addr: members[2].Addr()}); err != ErrClosed {
+		t.Fatalf("got %v, want %v", err, ErrClosed)
+	}
+}
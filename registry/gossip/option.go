@@ -0,0 +1,96 @@
+package gossip
+
+import (
+	"log"
+	"time"
+)
+
+type (
+	_Options struct {
+		advertiseAddr    string
+		seeds            []string
+		probeInterval    time.Duration
+		probeTimeout     time.Duration
+		indirectChecks   int
+		suspicionTimeout time.Duration
+		pushPullInterval time.Duration
+		deadReclaimTime  time.Duration
+		retransmitMult   int
+		logErrorFunc     func(msg string, keysAndValues ...interface{})
+		logInfoFunc      func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		probeInterval:    time.Second,
+		probeTimeout:     time.Millisecond * 500,
+		indirectChecks:   3,
+		suspicionTimeout: time.Second * 5,
+		pushPullInterval: time.Second * 30,
+		deadReclaimTime:  time.Minute,
+		retransmitMult:   4,
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+		logInfoFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithAdvertiseAddr is the addr other members use to reach this member, default is the bind addr
+func WithAdvertiseAddr(advertiseAddr string) Option {
+	return func(o *_Options) {
+		o.advertiseAddr = advertiseAddr
+	}
+}
+
+// WithSeeds are members to join at start and whenever this member is alone
+func WithSeeds(seeds ...string) Option {
+	return func(o *_Options) {
+		o.seeds = append(o.seeds, seeds...)
+	}
+}
+
+func WithProbeIntervalAndTimeout(probeInterval, probeTimeout time.Duration) Option {
+	return func(o *_Options) {
+		o.probeInterval = probeInterval
+		o.probeTimeout = probeTimeout
+	}
+}
+
+func WithIndirectChecks(indirectChecks int) Option {
+	return func(o *_Options) {
+		o.indirectChecks = indirectChecks
+	}
+}
+
+func WithSuspicionTimeout(suspicionTimeout time.Duration) Option {
+	return func(o *_Options) {
+		o.suspicionTimeout = suspicionTimeout
+	}
+}
+
+func WithPushPullInterval(pushPullInterval time.Duration) Option {
+	return func(o *_Options) {
+		o.pushPullInterval = pushPullInterval
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
+
+func WithLogInfoFunc(logInfoFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logInfoFunc = logInfoFunc
+	}
+}
@@ -0,0 +1,348 @@
+package gossip
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	messageTypePing    messageType = "ping"
+	messageTypeAck     messageType = "ack"
+	messageTypePingReq messageType = "ping-req"
+	messageTypeLeave   messageType = "leave"
+
+	maxDatagramBytes  = 65507
+	maxPiggybackBytes = 16 * 1024
+)
+
+type (
+	messageType string
+	_Message    struct {
+		Type    messageType `json:"type"`
+		SeqNo   uint64      `json:"seq_no"`
+		From    string      `json:"from"`
+		Target  string      `json:"target,omitempty"`
+		Members []*_Member  `json:"members,omitempty"`
+	}
+	_PushPull struct {
+		Members []*_Member `json:"members"`
+	}
+)
+
+func (d *_DiscoveryRegistry) serveUDP() {
+	defer d.loopWG.Done()
+	buf := make([]byte, maxDatagramBytes)
+	for {
+		n, from, err := d.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if d.isClosed() {
+				return
+			}
+			d.options.logErrorFunc("serveUDP", "err", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		msg := new(_Message)
+		if err := json.Unmarshal(buf[:n], msg); err != nil {
+			d.options.logErrorFunc("serveUDP", "from", from, "err", err)
+			continue
+		}
+		d.handleMessage(msg, from)
+	}
+}
+
+func (d *_DiscoveryRegistry) handleMessage(msg *_Message, from *net.UDPAddr) {
+	d.mutex.Lock()
+	for _, member := range msg.Members {
+		d.merge(member)
+	}
+	d.mutex.Unlock()
+	switch msg.Type {
+	case messageTypePing:
+		if msg.Target == d.self {
+			d.send(from.String(), &_Message{Type: messageTypeAck, SeqNo: msg.SeqNo})
+		}
+	case messageTypePingReq:
+		requester := from.String()
+		var seqNo uint64
+		seqNo = d.registerAckFunc(func() {
+			d.unregisterAckFunc(seqNo)
+			d.send(requester, &_Message{Type: messageTypeAck, SeqNo: msg.SeqNo})
+		})
+		time.AfterFunc(d.options.probeTimeout, func() {
+			d.unregisterAckFunc(seqNo)
+		})
+		d.send(msg.Target, &_Message{Type: messageTypePing, SeqNo: seqNo, Target: msg.Target})
+	case messageTypeAck:
+		d.mutex.Lock()
+		ackFunc := d.seqNoMapAckFunc[msg.SeqNo]
+		d.mutex.Unlock()
+		if ackFunc != nil {
+			ackFunc()
+		}
+	}
+}
+
+func (d *_DiscoveryRegistry) registerAckFunc(ackFunc func()) uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.seqNo++
+	d.seqNoMapAckFunc[d.seqNo] = ackFunc
+	return d.seqNo
+}
+
+func (d *_DiscoveryRegistry) unregisterAckFunc(seqNo uint64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.seqNoMapAckFunc, seqNo)
+}
+
+func (d *_DiscoveryRegistry) send(addr string, msg *_Message) {
+	if d.isClosed() {
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		d.options.logErrorFunc("send", "addr", addr, "err", err)
+		return
+	}
+	msg.From = d.self
+	d.mutex.Lock()
+	if msg.Members == nil {
+		msg.Members = d.piggyback()
+	}
+	bs, err := json.Marshal(msg)
+	d.mutex.Unlock()
+	if err != nil {
+		d.options.logErrorFunc("send", "msg", msg, "err", err)
+		return
+	}
+	if _, err := d.udpConn.WriteToUDP(bs, udpAddr); err != nil {
+		d.options.logErrorFunc("send", "addr", addr, "err", err)
+	}
+}
+
+func (d *_DiscoveryRegistry) queueBroadcast(addr string) {
+	d.addrMapTransmits[addr] = 0
+}
+
+// piggyback picks the least transmitted updates, every update is sent retransmitMult*log(n) times
+func (d *_DiscoveryRegistry) piggyback() []*_Member {
+	addrs := make([]string, 0, len(d.addrMapTransmits))
+	for addr := range d.addrMapTransmits {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return d.addrMapTransmits[addrs[i]] < d.addrMapTransmits[addrs[j]]
+	})
+	retransmitLimit := d.options.retransmitMult * int(math.Ceil(math.Log10(float64(len(d.addrMapMember)+1))))
+	var members []*_Member
+	bytes := 0
+	for _, addr := range addrs {
+		member, ok := d.addrMapMember[addr]
+		if !ok {
+			delete(d.addrMapTransmits, addr)
+			continue
+		}
+		bs, _ := json.Marshal(member)
+		if bytes += len(bs); bytes > maxPiggybackBytes && len(members) > 0 {
+			break
+		}
+		members = append(members, member)
+		if d.addrMapTransmits[addr]++; d.addrMapTransmits[addr] >= retransmitLimit {
+			delete(d.addrMapTransmits, addr)
+		}
+	}
+	return members
+}
+
+func (d *_DiscoveryRegistry) probeLoop() {
+	defer d.loopWG.Done()
+	ticker := time.NewTicker(d.options.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeCh:
+			return
+		case <-ticker.C:
+		}
+		d.probe()
+		d.reap()
+	}
+}
+
+// probe pings the next member, asks indirectChecks other members to ping it when there is no ack in time,
+// and suspects it when none of them gets an ack before the end of the probe interval
+func (d *_DiscoveryRegistry) probe() {
+	target := d.nextProbeTarget()
+	if target == "" {
+		return
+	}
+	ackCh := make(chan struct{}, 1)
+	seqNo := d.registerAckFunc(func() {
+		select {
+		case ackCh <- struct{}{}:
+		default:
+		}
+	})
+	defer d.unregisterAckFunc(seqNo)
+	d.send(target, &_Message{Type: messageTypePing, SeqNo: seqNo, Target: target})
+	select {
+	case <-ackCh:
+		return
+	case <-time.After(d.options.probeTimeout):
+	}
+	for _, addr := range d.randomMembers(d.options.indirectChecks, target) {
+		d.send(addr, &_Message{Type: messageTypePingReq, SeqNo: seqNo, Target: target})
+	}
+	select {
+	case <-ackCh:
+		return
+	case <-time.After(d.options.probeInterval - d.options.probeTimeout):
+	}
+	d.markState(target, memberStateSuspect)
+}
+
+// nextProbeTarget walks members in a shuffled round-robin order, so every member is probed in bounded time
+func (d *_DiscoveryRegistry) nextProbeTarget() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for round := 0; round < 2; round++ {
+		for len(d.probeQueue) > 0 {
+			addr := d.probeQueue[0]
+			d.probeQueue = d.probeQueue[1:]
+			if member, ok := d.addrMapMember[addr]; ok && member.State != memberStateDead && addr != d.self {
+				return addr
+			}
+		}
+		for addr := range d.addrMapMember {
+			d.probeQueue = append(d.probeQueue, addr)
+		}
+		rand.Shuffle(len(d.probeQueue), func(i, j int) {
+			d.probeQueue[i], d.probeQueue[j] = d.probeQueue[j], d.probeQueue[i]
+		})
+	}
+	return ""
+}
+
+func (d *_DiscoveryRegistry) randomMembers(n int, exclude string) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var addrs []string
+	for addr, member := range d.addrMapMember {
+		if addr != d.self && addr != exclude && member.State == memberStateAlive {
+			addrs = append(addrs, addr)
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+func (d *_DiscoveryRegistry) join() {
+	for _, seed := range d.options.seeds {
+		if seed == d.self {
+			continue
+		}
+		if err := d.pushPull(seed); err != nil {
+			d.options.logErrorFunc("join", "seed", seed, "err", err)
+		}
+	}
+}
+
+func (d *_DiscoveryRegistry) pushPullLoop() {
+	defer d.loopWG.Done()
+	ticker := time.NewTicker(d.options.pushPullInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeCh:
+			return
+		case <-ticker.C:
+		}
+		addrs := d.randomMembers(1, "")
+		if len(addrs) <= 0 { // alone, maybe partitioned away, try to rejoin
+			d.join()
+			continue
+		}
+		if err := d.pushPull(addrs[0]); err != nil {
+			d.options.logErrorFunc("pushPull", "addr", addrs[0], "err", err)
+		}
+	}
+}
+
+func (d *_DiscoveryRegistry) pushPull(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, d.options.probeInterval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(d.options.probeInterval * 5))
+	if err := json.NewEncoder(conn).Encode(d.fullState()); err != nil {
+		return err
+	}
+	remote := new(_PushPull)
+	if err := json.NewDecoder(conn).Decode(remote); err != nil {
+		return err
+	}
+	d.mergeFullState(remote)
+	return nil
+}
+
+func (d *_DiscoveryRegistry) serveTCP() {
+	defer d.loopWG.Done()
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			if d.isClosed() {
+				return
+			}
+			d.options.logErrorFunc("serveTCP", "err", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(d.options.probeInterval * 5))
+			remote := new(_PushPull)
+			if err := json.NewDecoder(conn).Decode(remote); err != nil {
+				d.options.logErrorFunc("serveTCP", "remote", conn.RemoteAddr(), "err", err)
+				return
+			}
+			if err := json.NewEncoder(conn).Encode(d.fullState()); err != nil {
+				d.options.logErrorFunc("serveTCP", "remote", conn.RemoteAddr(), "err", err)
+			}
+			d.mergeFullState(remote)
+		}()
+	}
+}
+
+func (d *_DiscoveryRegistry) fullState() *_PushPull {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state := &_PushPull{Members: make([]*_Member, 0, len(d.addrMapMember))}
+	for _, member := range d.addrMapMember {
+		state.Members = append(state.Members, member)
+	}
+	return state
+}
+
+func (d *_DiscoveryRegistry) mergeFullState(remote *_PushPull) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, member := range remote.Members {
+		d.merge(member)
+	}
+}
@@ -0,0 +1,304 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-productive/micro"
+	"github.com/go-productive/micro/registry"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	labelServiceName = "kubernetes.io/service-name"
+	watchTimeout     = time.Minute * 5
+)
+
+var (
+	errResourceExpired = errors.New("kubernetes: resource version expired")
+)
+
+type (
+	_Discovery struct {
+		apiServer string
+		targets   []Target
+		options   *_Options
+	}
+	Target struct {
+		ServiceName string // grpc service name, e.g. echo.Echo
+		Namespace   string
+		Service     string // kubernetes service owning the EndpointSlices
+		PortName    string // empty means the first port of the EndpointSlice
+	}
+	_TargetState struct {
+		target            Target
+		resourceVersion   string
+		sliceNameMapNodes map[string][]*registry.Node
+	}
+	_ObjectMeta struct {
+		Name            string            `json:"name"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+	}
+	_EndpointSlice struct {
+		Metadata  _ObjectMeta `json:"metadata"`
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+			Zone *string `json:"zone"`
+		} `json:"endpoints"`
+		Ports []struct {
+			Name *string `json:"name"`
+			Port *int32  `json:"port"`
+		} `json:"ports"`
+	}
+	_EndpointSliceList struct {
+		Metadata _ObjectMeta      `json:"metadata"`
+		Items    []_EndpointSlice `json:"items"`
+	}
+	_WatchEvent struct {
+		Type   string          `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	_Status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+// New apiServer is the kubernetes api server endpoint, e.g. https://kubernetes.default.svc
+func New(apiServer string, targets []Target, opts ...Option) *_Discovery {
+	return &_Discovery{
+		apiServer: strings.TrimSuffix(apiServer, "/"),
+		targets:   targets,
+		options:   newOptions(opts),
+	}
+}
+
+func (d *_Discovery) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_Discovery) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	states := make([]*_TargetState, 0, len(d.targets))
+	serviceNameMapNodes := make(map[string][]*registry.Node)
+	for _, target := range d.targets {
+		state := &_TargetState{target: target}
+		if err := d.list(ctx, state); err != nil {
+			return nil, nil, err
+		}
+		states = append(states, state)
+		serviceNameMapNodes[target.ServiceName] = append(serviceNameMapNodes[target.ServiceName], state.nodes()...)
+	}
+	eventChan := make(chan *registry.Event, 1)
+	var wg sync.WaitGroup
+	for _, state := range states {
+		wg.Add(1)
+		go func(state *_TargetState) {
+			defer wg.Done()
+			d.watch(ctx, state, eventChan)
+		}(state)
+	}
+	go func() {
+		wg.Wait()
+		close(eventChan)
+	}()
+	return eventChan, serviceNameMapNodes, nil
+}
+
+func (d *_Discovery) watch(ctx context.Context, state *_TargetState, eventCh chan<- *registry.Event) {
+	for ctx.Err() == nil {
+		err := d.watchOnce(ctx, state, eventCh)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if err != errResourceExpired {
+			d.options.logErrorFunc("watch", "target", state.target, "err", err)
+			sleep(ctx, time.Second)
+		}
+		oldNodes := state.nodes()
+		if err := d.list(ctx, state); err != nil {
+			if ctx.Err() == nil {
+				d.options.logErrorFunc("watch", "target", state.target, "err", err)
+			}
+			continue
+		}
+		d.emit(ctx, state.target.ServiceName, oldNodes, state.nodes(), eventCh)
+	}
+}
+
+func (d *_Discovery) list(ctx context.Context, state *_TargetState) error {
+	timeout, cancelFunc := context.WithTimeout(ctx, micro.Timeout)
+	defer cancelFunc()
+	rsp, err := d.get(timeout, state.target, nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	var list _EndpointSliceList
+	if err := json.NewDecoder(rsp.Body).Decode(&list); err != nil {
+		return err
+	}
+	state.resourceVersion = list.Metadata.ResourceVersion
+	state.sliceNameMapNodes = make(map[string][]*registry.Node, len(list.Items))
+	for i := range list.Items {
+		state.sliceNameMapNodes[list.Items[i].Metadata.Name] = d.toNodes(state.target, &list.Items[i])
+	}
+	return nil
+}
+
+// watchOnce returns nil when the api server ends the watch normally
+func (d *_Discovery) watchOnce(ctx context.Context, state *_TargetState, eventCh chan<- *registry.Event) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"allowWatchBookmarks": {"true"},
+		"resourceVersion":     {state.resourceVersion},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout.Seconds()))},
+	}
+	timeout, cancelFunc := context.WithTimeout(ctx, watchTimeout+micro.Timeout)
+	defer cancelFunc()
+	rsp, err := d.get(timeout, state.target, query)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	decoder := json.NewDecoder(rsp.Body)
+	for decoder.More() {
+		var watchEvent _WatchEvent
+		if err := decoder.Decode(&watchEvent); err != nil {
+			return err
+		}
+		if watchEvent.Type == "ERROR" {
+			var status _Status
+			if err := json.Unmarshal(watchEvent.Object, &status); err != nil {
+				return err
+			}
+			if status.Code == http.StatusGone {
+				return errResourceExpired
+			}
+			return fmt.Errorf("kubernetes: watch error code:%v message:%v", status.Code, status.Message)
+		}
+		var slice _EndpointSlice
+		if err := json.Unmarshal(watchEvent.Object, &slice); err != nil {
+			return err
+		}
+		state.resourceVersion = slice.Metadata.ResourceVersion
+		oldNodes := state.nodes()
+		switch watchEvent.Type {
+		case "ADDED", "MODIFIED":
+			state.sliceNameMapNodes[slice.Metadata.Name] = d.toNodes(state.target, &slice)
+		case "DELETED":
+			delete(state.sliceNameMapNodes, slice.Metadata.Name)
+		default: // BOOKMARK only moves resourceVersion
+			continue
+		}
+		d.emit(ctx, state.target.ServiceName, oldNodes, state.nodes(), eventCh)
+	}
+	return nil
+}
+
+func (d *_Discovery) emit(ctx context.Context, serviceName string, oldNodes, newNodes []*registry.Node, eventCh chan<- *registry.Event) {
+	events := registry.Diff(
+		map[string][]*registry.Node{serviceName: oldNodes},
+		map[string][]*registry.Node{serviceName: newNodes},
+	)
+	for _, event := range events {
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *_Discovery) get(ctx context.Context, target Target, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = make(url.Values)
+	}
+	query.Set("labelSelector", labelServiceName+"="+target.Service)
+	rawURL := fmt.Sprintf("%v/apis/discovery.k8s.io/v1/namespaces/%v/endpointslices?%v", d.apiServer, url.PathEscape(target.Namespace), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	token, err := d.options.tokenFunc()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rsp, err := d.options.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusGone {
+		rsp.Body.Close()
+		return nil, errResourceExpired
+	}
+	if rsp.StatusCode != http.StatusOK {
+		bs, _ := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		return nil, fmt.Errorf("kubernetes: GET %v status:%v body:%v", rawURL, rsp.StatusCode, string(bs))
+	}
+	return rsp, nil
+}
+
+func (d *_Discovery) toNodes(target Target, slice *_EndpointSlice) []*registry.Node {
+	port := int32(-1)
+	for _, p := range slice.Ports {
+		if p.Port != nil && (target.PortName == "" || p.Name != nil && *p.Name == target.PortName) {
+			port = *p.Port
+			break
+		}
+	}
+	if port < 0 {
+		return nil
+	}
+	var nodes []*registry.Node
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready { // nil ready means unknown, treated as ready
+			continue
+		}
+		metadata := &registry.Metadata{Labels: slice.Metadata.Labels}
+		if endpoint.Zone != nil {
+			metadata.Zone = *endpoint.Zone
+		}
+		bs := registry.EncodeMetadata(metadata)
+		for _, address := range endpoint.Addresses {
+			nodes = append(nodes, &registry.Node{
+				ServiceName: target.ServiceName,
+				Addr:        net.JoinHostPort(address, strconv.Itoa(int(port))),
+				Metadata:    bs,
+			})
+		}
+	}
+	return nodes
+}
+
+func (s *_TargetState) nodes() []*registry.Node {
+	var nodes []*registry.Node
+	for _, sliceNodes := range s.sliceNameMapNodes {
+		nodes = append(nodes, sliceNodes...)
+	}
+	return nodes
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,274 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+type (
+	// _FakeAPIServer serves list and watch of EndpointSlices, watches replay the changes after their resourceVersion
+	_FakeAPIServer struct {
+		mutex           sync.Mutex
+		resourceVersion int
+		expiredVersion  int // a watch from this resourceVersion or older gets 410
+		nameMapSlice    map[string]map[string]interface{}
+		watchEvents     []*_FakeWatchEvent
+		changedCh       chan struct{} // closed and replaced on every change
+		endWatchesCh    chan struct{} // closed and replaced to end the open watches
+		lists           int
+		authorizations  []string
+		labelSelectors  []string
+	}
+	_FakeWatchEvent struct {
+		resourceVersion int
+		bs              []byte
+	}
+)
+
+func newFakeAPIServer(t *testing.T) (*_FakeAPIServer, string) {
+	f := &_FakeAPIServer{
+		resourceVersion: 1,
+		nameMapSlice:    make(map[string]map[string]interface{}),
+		changedCh:       make(chan struct{}),
+		endWatchesCh:    make(chan struct{}),
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *_FakeAPIServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	f.mutex.Lock()
+	f.authorizations = append(f.authorizations, r.Header.Get("Authorization"))
+	f.labelSelectors = append(f.labelSelectors, query.Get("labelSelector"))
+	if query.Get("watch") != "true" {
+		f.lists++
+		items := make([]map[string]interface{}, 0, len(f.nameMapSlice))
+		for _, slice := range f.nameMapSlice {
+			items = append(items, slice)
+		}
+		bs, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{"resourceVersion": strconv.Itoa(f.resourceVersion)},
+			"items":    items,
+		})
+		f.mutex.Unlock()
+		_, _ = w.Write(bs)
+		return
+	}
+	f.mutex.Unlock()
+
+	resourceVersion, _ := strconv.Atoi(query.Get("resourceVersion"))
+	flusher := w.(http.Flusher)
+	for {
+		f.mutex.Lock()
+		if resourceVersion <= f.expiredVersion {
+			f.mutex.Unlock()
+			bs, _ := json.Marshal(map[string]interface{}{
+				"type":   "ERROR",
+				"object": map[string]interface{}{"code": http.StatusGone, "message": "too old resource version"},
+			})
+			_, _ = w.Write(bs)
+			return
+		}
+		for _, watchEvent := range f.watchEvents {
+			if watchEvent.resourceVersion > resourceVersion {
+				_, _ = w.Write(watchEvent.bs)
+				resourceVersion = watchEvent.resourceVersion
+			}
+		}
+		changedCh, endWatchesCh := f.changedCh, f.endWatchesCh
+		f.mutex.Unlock()
+		flusher.Flush()
+		select {
+		case <-changedCh:
+		case <-endWatchesCh:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *_FakeAPIServer) put(slice map[string]interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	name := slice["metadata"].(map[string]interface{})["name"].(string)
+	eventType := "MODIFIED"
+	if _, ok := f.nameMapSlice[name]; !ok {
+		eventType = "ADDED"
+	}
+	f.nameMapSlice[name] = slice
+	f.change(eventType, slice)
+}
+
+func (f *_FakeAPIServer) remove(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	slice := f.nameMapSlice[name]
+	delete(f.nameMapSlice, name)
+	f.change("DELETED", slice)
+}
+
+// change must be called with mutex held
+func (f *_FakeAPIServer) change(eventType string, slice map[string]interface{}) {
+	f.resourceVersion++
+	slice["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.resourceVersion)
+	bs, _ := json.Marshal(map[string]interface{}{"type": eventType, "object": slice})
+	f.watchEvents = append(f.watchEvents, &_FakeWatchEvent{resourceVersion: f.resourceVersion, bs: bs})
+	close(f.changedCh)
+	f.changedCh = make(chan struct{})
+}
+
+// endWatches ends the open watches normally, like the api server does at timeoutSeconds
+func (f *_FakeAPIServer) endWatches() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	close(f.endWatchesCh)
+	f.endWatchesCh = make(chan struct{})
+}
+
+// expire drops the history of the watches, so the next watch has to list again, slices change in between
+func (f *_FakeAPIServer) expire(slices ...map[string]interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, slice := range slices {
+		f.resourceVersion++
+		slice["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.resourceVersion)
+		f.nameMapSlice[slice["metadata"].(map[string]interface{})["name"].(string)] = slice
+	}
+	f.expiredVersion, f.watchEvents = f.resourceVersion-1, nil
+	close(f.endWatchesCh)
+	f.endWatchesCh = make(chan struct{})
+}
+
+func (f *_FakeAPIServer) listCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lists
+}
+
+func newSlice(name string, endpoints ...map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":   name,
+			"labels": map[string]string{labelServiceName: "echo", "version": "v1"},
+		},
+		"endpoints": endpoints,
+		"ports":     []map[string]interface{}{{"name": "metrics", "port": 9090}, {"name": "grpc", "port": 8080}},
+	}
+}
+
+func newEndpoint(address string, ready bool) map[string]interface{} {
+	return map[string]interface{}{
+		"addresses":  []string{address},
+		"conditions": map[string]interface{}{"ready": ready},
+		"zone":       "a",
+	}
+}
+
+func newTestDiscovery(t *testing.T, apiServer string) *_Discovery {
+	return New(apiServer, []Target{{ServiceName: "echo.Echo", Namespace: "default", Service: "echo", PortName: "grpc"}},
+		WithBearerToken("token"),
+		WithLogErrorFunc(func(msg string, keysAndValues ...interface{}) {
+			t.Log(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		}),
+	)
+}
+
+func watchAndGet(t *testing.T, d *_Discovery) (<-chan *registry.Event, map[string][]*registry.Node) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancelFunc()
+		for range eventCh {
+		}
+	})
+	return eventCh, serviceNameMapNodes
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event, want *registry.Event) {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		if event.Type != want.Type || event.Node.Addr != want.Node.Addr {
+			t.Fatalf("got %v of %v, want %v of %v", event.Type, event.Node.Addr, want.Type, want.Node.Addr)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatalf("no event received, want %v of %v", want.Type, want.Node.Addr)
+	}
+}
+
+func TestWatchAndGet(t *testing.T) {
+	apiServer, addr := newFakeAPIServer(t)
+	apiServer.put(newSlice("echo-a", newEndpoint("10.0.0.10", true), newEndpoint("10.0.0.11", false)))
+	eventCh, serviceNameMapNodes := watchAndGet(t, newTestDiscovery(t, addr))
+	nodes := serviceNameMapNodes["echo.Echo"]
+	if len(nodes) != 1 || nodes[0].Addr != "10.0.0.10:8080" {
+		t.Fatalf("got %v, want only the ready endpoint on the grpc port", nodes)
+	}
+	if metadata := nodes[0].Meta(); metadata.Zone != "a" || metadata.Labels["version"] != "v1" {
+		t.Fatalf("got %+v, want the zone and labels of the slice", metadata)
+	}
+	apiServer.mutex.Lock()
+	authorization, labelSelector := apiServer.authorizations[0], apiServer.labelSelectors[0]
+	apiServer.mutex.Unlock()
+	if authorization != "Bearer token" || labelSelector != labelServiceName+"=echo" {
+		t.Fatalf("got %q and %q, want the bearer token and the service label selector", authorization, labelSelector)
+	}
+
+	apiServer.put(newSlice("echo-b", newEndpoint("10.0.0.20", true)))
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeCreate, Node: &registry.Node{Addr: "10.0.0.20:8080"}})
+	apiServer.remove("echo-b")
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeDelete, Node: &registry.Node{Addr: "10.0.0.20:8080"}})
+}
+
+func TestReadiness(t *testing.T) {
+	apiServer, addr := newFakeAPIServer(t)
+	apiServer.put(newSlice("echo-a", newEndpoint("10.0.0.10", true), newEndpoint("10.0.0.11", false)))
+	eventCh, _ := watchAndGet(t, newTestDiscovery(t, addr))
+
+	apiServer.put(newSlice("echo-a", newEndpoint("10.0.0.10", true), newEndpoint("10.0.0.11", true)))
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeCreate, Node: &registry.Node{Addr: "10.0.0.11:8080"}})
+	apiServer.put(newSlice("echo-a", newEndpoint("10.0.0.10", false), newEndpoint("10.0.0.11", true)))
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeDelete, Node: &registry.Node{Addr: "10.0.0.10:8080"}})
+}
+
+func TestWatchReconnect(t *testing.T) {
+	apiServer, addr := newFakeAPIServer(t)
+	apiServer.put(newSlice("echo-a", newEndpoint("10.0.0.10", true)))
+	eventCh, _ := watchAndGet(t, newTestDiscovery(t, addr))
+
+	// a watch ended by the api server resumes from its resourceVersion without listing again
+	apiServer.endWatches()
+	apiServer.put(newSlice("echo-b", newEndpoint("10.0.0.20", true)))
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeCreate, Node: &registry.Node{Addr: "10.0.0.20:8080"}})
+	if lists := apiServer.listCount(); lists != 1 {
+		t.Fatalf("got %v lists, want 1", lists)
+	}
+
+	// an expired resourceVersion lists again, and the changes missed in between become events
+	apiServer.expire(newSlice("echo-b", newEndpoint("10.0.0.21", true)))
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeCreate, Node: &registry.Node{Addr: "10.0.0.21:8080"}})
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeDelete, Node: &registry.Node{Addr: "10.0.0.20:8080"}})
+	if lists := apiServer.listCount(); lists != 2 {
+		t.Fatalf("got %v lists, want 2", lists)
+	}
+	apiServer.remove("echo-b")
+	receiveEvent(t, eventCh, &registry.Event{Type: registry.NodeEventTypeDelete, Node: &registry.Node{Addr: "10.0.0.21:8080"}})
+}
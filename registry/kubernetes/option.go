@@ -0,0 +1,92 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type (
+	_Options struct {
+		httpClient   *http.Client
+		tokenFunc    func() (string, error)
+		logErrorFunc func(msg string, keysAndValues ...interface{})
+	}
+	Option func(*_Options)
+)
+
+func newOptions(opts []Option) *_Options {
+	o := &_Options{
+		httpClient: http.DefaultClient,
+		tokenFunc: func() (string, error) {
+			return "", nil
+		},
+		logErrorFunc: func(msg string, keysAndValues ...interface{}) {
+			log.Println(append([]interface{}{"msg", msg}, keysAndValues...)...)
+		},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *_Options) {
+		o.httpClient = httpClient
+	}
+}
+
+func WithBearerToken(token string) Option {
+	return func(o *_Options) {
+		o.tokenFunc = func() (string, error) {
+			return token, nil
+		}
+	}
+}
+
+// WithBearerTokenFile reads the token on every request, projected service account tokens are rotated
+func WithBearerTokenFile(path string) Option {
+	return func(o *_Options) {
+		o.tokenFunc = func() (string, error) {
+			bs, err := ioutil.ReadFile(path)
+			return strings.TrimSpace(string(bs)), err
+		}
+	}
+}
+
+// WithInCluster uses the pod's service account, apiServer should be https://kubernetes.default.svc
+func WithInCluster() Option {
+	return func(o *_Options) {
+		pem, err := ioutil.ReadFile(inClusterCAFile)
+		if err != nil {
+			panic(err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(pem) {
+			panic(errors.New("no certificate in " + inClusterCAFile))
+		}
+		o.httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: certPool},
+			},
+		}
+		WithBearerTokenFile(inClusterTokenFile)(o)
+	}
+}
+
+func WithLogErrorFunc(logErrorFunc func(msg string, keysAndValues ...interface{})) Option {
+	return func(o *_Options) {
+		o.logErrorFunc = logErrorFunc
+	}
+}
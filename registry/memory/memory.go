@@ -0,0 +1,202 @@
+package memory
+
+import (
+	"context"
+	"github.com/go-productive/micro/registry"
+	"sync"
+)
+
+type (
+	_DiscoveryRegistry struct {
+		mutex                    sync.Mutex
+		serviceNameMapAddrMapReg map[string]map[string]*_Registration
+		watchers                 []*_Watcher
+		keyMapConfig             map[string][]byte
+		keyMapConfigChs          map[string][]chan []byte
+	}
+	_Registration struct {
+		node *registry.Node
+	}
+	_Watcher struct {
+		mutex    sync.Mutex
+		events   []*registry.Event
+		notifyCh chan struct{}
+	}
+)
+
+func New() *_DiscoveryRegistry {
+	return &_DiscoveryRegistry{
+		serviceNameMapAddrMapReg: make(map[string]map[string]*_Registration),
+		keyMapConfig:             make(map[string][]byte),
+		keyMapConfigChs:          make(map[string][]chan []byte),
+	}
+}
+
+func (d *_DiscoveryRegistry) Register(node *registry.Node) (func(), error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	addrMapReg, ok := d.serviceNameMapAddrMapReg[node.ServiceName]
+	if !ok {
+		addrMapReg = make(map[string]*_Registration)
+		d.serviceNameMapAddrMapReg[node.ServiceName] = addrMapReg
+	}
+	eventType := registry.NodeEventTypeCreate
+	if _, ok := addrMapReg[node.Addr]; ok {
+		eventType = registry.NodeEventTypeUpdate
+	}
+	reg := &_Registration{node: node}
+	addrMapReg[node.Addr] = reg
+	d.broadcast(&registry.Event{Type: eventType, Node: node})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.deregister(reg)
+		})
+	}, nil
+}
+
+func (d *_DiscoveryRegistry) deregister(reg *_Registration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	addrMapReg := d.serviceNameMapAddrMapReg[reg.node.ServiceName]
+	if addrMapReg[reg.node.Addr] != reg { // replaced by a later Register of the same addr
+		return
+	}
+	delete(addrMapReg, reg.node.Addr)
+	if len(addrMapReg) <= 0 {
+		delete(d.serviceNameMapAddrMapReg, reg.node.ServiceName)
+	}
+	d.broadcast(&registry.Event{Type: registry.NodeEventTypeDelete, Node: reg.node})
+}
+
+func (d *_DiscoveryRegistry) WatchAndGet() (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	return d.WatchAndGetContext(context.Background())
+}
+
+func (d *_DiscoveryRegistry) WatchAndGetContext(ctx context.Context) (<-chan *registry.Event, map[string][]*registry.Node, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	serviceNameMapNodes := make(map[string][]*registry.Node, len(d.serviceNameMapAddrMapReg))
+	for serviceName, addrMapReg := range d.serviceNameMapAddrMapReg {
+		for _, reg := range addrMapReg {
+			serviceNameMapNodes[serviceName] = append(serviceNameMapNodes[serviceName], reg.node)
+		}
+	}
+	watcher := &_Watcher{
+		notifyCh: make(chan struct{}, 1),
+	}
+	d.watchers = append(d.watchers, watcher)
+	eventCh := make(chan *registry.Event, 1)
+	go func() {
+		watcher.loop(ctx, eventCh)
+		d.removeWatcher(watcher)
+		close(eventCh)
+	}()
+	return eventCh, serviceNameMapNodes, nil
+}
+
+func (d *_DiscoveryRegistry) removeWatcher(watcher *_Watcher) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	watchers := make([]*_Watcher, 0, len(d.watchers))
+	for _, w := range d.watchers {
+		if w != watcher {
+			watchers = append(watchers, w)
+		}
+	}
+	d.watchers = watchers
+}
+
+func (d *_DiscoveryRegistry) broadcast(event *registry.Event) {
+	for _, watcher := range d.watchers {
+		watcher.push(event)
+	}
+}
+
+// PutConfig sets the config of key, nil value deletes it
+func (d *_DiscoveryRegistry) PutConfig(key string, value []byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if value == nil {
+		delete(d.keyMapConfig, key)
+	} else {
+		d.keyMapConfig[key] = value
+	}
+	for _, configCh := range d.keyMapConfigChs[key] {
+		sendLatest(configCh, value)
+	}
+}
+
+// WatchConfig a slow subscriber misses intermediate values, but always gets the latest one
+func (d *_DiscoveryRegistry) WatchConfig(key string) (<-chan []byte, error) {
+	return d.WatchConfigContext(context.Background(), key)
+}
+
+func (d *_DiscoveryRegistry) WatchConfigContext(ctx context.Context, key string) (<-chan []byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	configCh := make(chan []byte, 1)
+	configCh <- d.keyMapConfig[key]
+	d.keyMapConfigChs[key] = append(d.keyMapConfigChs[key], configCh)
+	go func() {
+		<-ctx.Done()
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		configChs := make([]chan []byte, 0, len(d.keyMapConfigChs[key]))
+		for _, ch := range d.keyMapConfigChs[key] {
+			if ch != configCh {
+				configChs = append(configChs, ch)
+			}
+		}
+		d.keyMapConfigChs[key] = configChs
+		close(configCh)
+	}()
+	return configCh, nil
+}
+
+func sendLatest(configCh chan []byte, value []byte) {
+	for {
+		select {
+		case configCh <- value:
+			return
+		default:
+		}
+		select {
+		case <-configCh:
+		default:
+		}
+	}
+}
+
+// push never blocks, so a slow subscriber can not stall Register or the other subscribers
+func (w *_Watcher) push(event *registry.Event) {
+	w.mutex.Lock()
+	w.events = append(w.events, event)
+	w.mutex.Unlock()
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *_Watcher) loop(ctx context.Context, eventCh chan<- *registry.Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.notifyCh:
+		}
+		w.mutex.Lock()
+		events := w.events
+		w.events = nil
+		w.mutex.Unlock()
+		for _, event := range events {
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
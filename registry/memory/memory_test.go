@@ -0,0 +1,244 @@
+package memory
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-productive/micro/registry"
+)
+
+func receiveEvent(t *testing.T, eventCh <-chan *registry.Event) *registry.Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func receiveConfig(t *testing.T, configCh <-chan []byte) []byte {
+	t.Helper()
+	select {
+	case value := <-configCh:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("no config received")
+		return nil
+	}
+}
+
+func TestWatchAndGet(t *testing.T) {
+	d := New()
+	node := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	if _, err := d.Register(node); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	eventCh, serviceNameMapNodes, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := serviceNameMapNodes["echo.Echo"]; len(nodes) != 1 || nodes[0].Addr != node.Addr {
+		t.Fatalf("got %v, want %v", nodes, node)
+	}
+
+	newNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"}
+	deregisterFunc, err := d.Register(newNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeCreate || event.Node != newNode {
+		t.Fatalf("got %v, want create of %v", event, newNode)
+	}
+	updatedNode := &registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080", Metadata: []byte(`{"zone":"a"}`)}
+	updatedDeregisterFunc, err := d.Register(updatedNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeUpdate || event.Node != updatedNode {
+		t.Fatalf("got %v, want update of %v", event, updatedNode)
+	}
+
+	deregisterFunc() // replaced by updatedNode, so nothing is deleted
+	updatedDeregisterFunc()
+	updatedDeregisterFunc()
+	if event := receiveEvent(t, eventCh); event.Type != registry.NodeEventTypeDelete || event.Node != updatedNode {
+		t.Fatalf("got %v, want delete of %v", event, updatedNode)
+	}
+	select {
+	case event := <-eventCh:
+		t.Fatalf("got %v, want no more event", event)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestWatchersFanOut(t *testing.T) {
+	d := New()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var eventChs []<-chan *registry.Event
+	for i := 0; i < 3; i++ {
+		eventCh, _, err := d.WatchAndGetContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventChs = append(eventChs, eventCh)
+	}
+	cancelledCtx, cancelWatcher := context.WithCancel(context.Background())
+	cancelledCh, _, err := d.WatchAndGetContext(cancelledCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelWatcher()
+	for range cancelledCh {
+	}
+
+	// eventChs[0] is never read, it must not hold the events back from the other watchers
+	var wg sync.WaitGroup
+	for _, eventCh := range eventChs[1:] {
+		wg.Add(1)
+		go func(eventCh <-chan *registry.Event) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				select {
+				case event := <-eventCh:
+					if want := "10.0.0." + strconv.Itoa(i+10) + ":8080"; event.Node.Addr != want {
+						t.Errorf("got %v, want %v, events must keep Register order", event.Node.Addr, want)
+						return
+					}
+				case <-time.After(time.Second):
+					t.Error("no event received")
+					return
+				}
+			}
+		}(eventCh)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := d.Register(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0." + strconv.Itoa(i+10) + ":8080"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	if event := receiveEvent(t, eventChs[0]); event.Node.Addr != "10.0.0.10:8080" {
+		t.Fatalf("got %v, want the first event kept for the slow watcher", event.Node)
+	}
+}
+
+func TestWatchAndGetCancel(t *testing.T) {
+	d := New()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, _, err := d.WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancelFunc()
+	for range eventCh {
+	}
+	// Register must not block on the removed watcher
+	if _, err := d.Register(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.watchers) != 0 {
+		t.Fatalf("got %v watchers, want 0", len(d.watchers))
+	}
+}
+
+func TestCancelWhileRegistering(t *testing.T) {
+	d := New()
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var eventChs []<-chan *registry.Event
+	for i := 0; i < 3; i++ {
+		eventCh, _, err := d.WatchAndGetContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventChs = append(eventChs, eventCh)
+	}
+	cancelledCtx, cancelWatcher := context.WithCancel(context.Background())
+	cancelledCh, _, err := d.WatchAndGetContext(cancelledCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const registers = 100
+	var wg sync.WaitGroup
+	for i := 0; i < registers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			deregisterFunc, err := d.Register(&registry.Node{ServiceName: "echo.Echo", Addr: "10.0.1." + strconv.Itoa(i) + ":8080"})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			deregisterFunc()
+		}(i)
+	}
+	// the cancelled watcher stops in the middle of the events, the others still get all of them
+	<-cancelledCh
+	cancelWatcher()
+	for range cancelledCh {
+	}
+	for _, eventCh := range eventChs {
+		wg.Add(1)
+		go func(eventCh <-chan *registry.Event) {
+			defer wg.Done()
+			addrMapEvents := make(map[string]int)
+			for i := 0; i < registers*2; i++ {
+				select {
+				case event := <-eventCh:
+					addrMapEvents[event.Node.Addr]++
+				case <-time.After(time.Second):
+					t.Errorf("got %v events, want %v", i, registers*2)
+					return
+				}
+			}
+			if len(addrMapEvents) != registers {
+				t.Errorf("got events of %v nodes, want %v", len(addrMapEvents), registers)
+			}
+		}(eventCh)
+	}
+	wg.Wait()
+}
+
+func TestWatchConfig(t *testing.T) {
+	d := New()
+	d.PutConfig("key", []byte("v1"))
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	configCh, err := d.WatchConfigContext(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := receiveConfig(t, configCh); string(value) != "v1" {
+		t.Fatalf("got %q, want v1", value)
+	}
+
+	// a slow subscriber only gets the latest value
+	d.PutConfig("key", []byte("v2"))
+	d.PutConfig("key", []byte("v3"))
+	if value := receiveConfig(t, configCh); string(value) != "v3" {
+		t.Fatalf("got %q, want v3", value)
+	}
+	d.PutConfig("key", nil)
+	if value := receiveConfig(t, configCh); value != nil {
+		t.Fatalf("got %q, want nil", value)
+	}
+
+	cancelFunc()
+	for range configCh {
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.keyMapConfigChs["key"]) != 0 {
+		t.Fatalf("got %v subscribers, want 0", len(d.keyMapConfigChs["key"]))
+	}
+}
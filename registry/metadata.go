@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	DefaultWeight = 100
+)
+
+var (
+	metadataPrefix = []byte("micro/v1:")
+)
+
+type (
+	// Metadata is encoded as metadataPrefix followed by json, values without the prefix are
+	// raw metadata of older servers and are decoded into Raw, so they keep working
+	Metadata struct {
+		Version   string            `json:"version,omitempty"`
+		Zone      string            `json:"zone,omitempty"`
+		Region    string            `json:"region,omitempty"`
+		Weight    int               `json:"weight,omitempty"`
+		Tags      []string          `json:"tags,omitempty"`
+		Labels    map[string]string `json:"labels,omitempty"`
+		StartTime time.Time         `json:"start_time"`
+		Raw       []byte            `json:"raw,omitempty"`
+	}
+	// _DecodedMetadata remembers the bytes it is decoded from, so a node whose Metadata changes is decoded again
+	_DecodedMetadata struct {
+		bs       []byte
+		metadata *Metadata
+	}
+)
+
+// EncodeMetadata keeps Raw as is when there is nothing else, so older clients still read the same bytes,
+// otherwise Raw is encoded along with the other fields
+func EncodeMetadata(metadata *Metadata) []byte {
+	if metadata == nil {
+		return nil
+	}
+	if metadata.IsRaw() {
+		return metadata.Raw
+	}
+	bs, _ := json.Marshal(metadata)
+	return append(append([]byte(nil), metadataPrefix...), bs...)
+}
+
+func (m *Metadata) IsRaw() bool {
+	return m.Version == "" && m.Zone == "" && m.Region == "" && m.Weight == 0 &&
+		len(m.Tags) <= 0 && len(m.Labels) <= 0 && m.StartTime.IsZero()
+}
+
+func DecodeMetadata(bs []byte) *Metadata {
+	metadata := new(Metadata)
+	if bytes.HasPrefix(bs, metadataPrefix) && json.Unmarshal(bs[len(metadataPrefix):], metadata) == nil {
+		return metadata
+	}
+	return &Metadata{Raw: bs}
+}
+
+// Meta is decoded once per node, the returned value is shared and must not be modified
+func (n *Node) Meta() *Metadata {
+	if decoded, ok := n.decoded.Load().(*_DecodedMetadata); ok && bytes.Equal(decoded.bs, n.Metadata) {
+		return decoded.metadata
+	}
+	metadata := DecodeMetadata(n.Metadata)
+	n.decoded.Store(&_DecodedMetadata{bs: append([]byte(nil), n.Metadata...), metadata: metadata})
+	return metadata
+}
+
+func (n *Node) Weight() int {
+	if weight := n.Meta().Weight; weight > 0 {
+		return weight
+	}
+	return DefaultWeight
+}
@@ -0,0 +1,32 @@
+package registry
+
+import (
+	"testing"
+)
+
+func TestEncodeMetadata(t *testing.T) {
+	if bs := EncodeMetadata(&Metadata{Raw: []byte("v1")}); string(bs) != "v1" {
+		t.Fatalf("got %q, want the raw bytes as is", bs)
+	}
+	metadata := DecodeMetadata(EncodeMetadata(&Metadata{Zone: "a", Weight: 50, Raw: []byte("v1")}))
+	if metadata.Zone != "a" || metadata.Weight != 50 || string(metadata.Raw) != "v1" {
+		t.Fatalf("got %+v, want zone, weight and raw kept together", metadata)
+	}
+	if metadata := DecodeMetadata([]byte("v1")); !metadata.IsRaw() || string(metadata.Raw) != "v1" {
+		t.Fatalf("got %+v, want raw metadata of an older server", metadata)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	node := &Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: EncodeMetadata(&Metadata{Zone: "a"})}
+	if first := node.Meta(); first.Zone != "a" || node.Meta() != first {
+		t.Fatalf("got %+v, want zone a decoded once", first)
+	}
+	node.Metadata = EncodeMetadata(&Metadata{Zone: "b", Weight: 50})
+	if metadata := node.Meta(); metadata.Zone != "b" || node.Weight() != 50 {
+		t.Fatalf("got %+v, want the changed metadata decoded again", metadata)
+	}
+	if weight := (&Node{Metadata: []byte("v1")}).Weight(); weight != DefaultWeight {
+		t.Fatalf("got %v, want %v", weight, DefaultWeight)
+	}
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+type (
+	_MultiDiscovery struct {
+		discoveries []Discovery
+	}
+	_MultiRegistry struct {
+		registries []Registry
+	}
+	_MultiState struct {
+		mutex          sync.Mutex
+		sourceKeyNodes []map[string]*Node
+		keyMapNode     map[string]*Node
+	}
+)
+
+// Multi merges nodes of several discoveries, a node found in more than one of them is deduped by ServiceName+Addr
+// and its metadata comes from the first discovery that has it, so put the discovery that takes precedence first
+func Multi(discoveries ...Discovery) Discovery {
+	return &_MultiDiscovery{discoveries: discoveries}
+}
+
+// MultiRegistry registers every node in all registries, the deregisterFunc deregisters it from all of them
+func MultiRegistry(registries ...Registry) Registry {
+	return &_MultiRegistry{registries: registries}
+}
+
+func (m *_MultiDiscovery) WatchAndGet() (<-chan *Event, map[string][]*Node, error) {
+	return m.WatchAndGetContext(context.Background())
+}
+
+func (m *_MultiDiscovery) WatchAndGetContext(ctx context.Context) (_ <-chan *Event, _ map[string][]*Node, err error) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer func() {
+		if err != nil { // stops the discoveries already watching
+			cancelFunc()
+		}
+	}()
+	state := &_MultiState{
+		sourceKeyNodes: make([]map[string]*Node, len(m.discoveries)),
+		keyMapNode:     make(map[string]*Node),
+	}
+	sourceEventChs := make([]<-chan *Event, len(m.discoveries))
+	for i, discovery := range m.discoveries {
+		eventCh, serviceNameMapNodes, err := WatchAndGet(ctx, discovery)
+		if err != nil {
+			return nil, nil, err
+		}
+		sourceEventChs[i] = eventCh
+		state.sourceKeyNodes[i] = make(map[string]*Node)
+		for _, nodes := range serviceNameMapNodes {
+			for _, node := range nodes {
+				state.sourceKeyNodes[i][multiKey(node)] = node
+			}
+		}
+	}
+	serviceNameMapNodes := make(map[string][]*Node)
+	for i := len(state.sourceKeyNodes) - 1; i >= 0; i-- {
+		for key, node := range state.sourceKeyNodes[i] {
+			state.keyMapNode[key] = node
+		}
+	}
+	for _, node := range state.keyMapNode {
+		serviceNameMapNodes[node.ServiceName] = append(serviceNameMapNodes[node.ServiceName], node)
+	}
+
+	eventChan := make(chan *Event, 1)
+	var wg sync.WaitGroup
+	for i, sourceEventCh := range sourceEventChs {
+		wg.Add(1)
+		go func(source int, sourceEventCh <-chan *Event) {
+			defer wg.Done()
+			for event := range sourceEventCh {
+				state.handleEvent(ctx, source, event, eventChan)
+			}
+		}(i, sourceEventCh)
+	}
+	go func() {
+		wg.Wait()
+		cancelFunc()
+		close(eventChan)
+	}()
+	return eventChan, serviceNameMapNodes, nil
+}
+
+// handleEvent sends the event under the lock, so events of one node keep their order across discoveries
+func (s *_MultiState) handleEvent(ctx context.Context, source int, event *Event, eventCh chan<- *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := multiKey(event.Node)
+	if event.Type == NodeEventTypeDelete {
+		delete(s.sourceKeyNodes[source], key)
+	} else {
+		s.sourceKeyNodes[source][key] = event.Node
+	}
+	var newNode *Node
+	for _, keyMapNode := range s.sourceKeyNodes {
+		if node, ok := keyMapNode[key]; ok {
+			newNode = node
+			break
+		}
+	}
+	oldNode, ok := s.keyMapNode[key]
+	switch {
+	case !ok && newNode != nil:
+		s.keyMapNode[key] = newNode
+		send(ctx, eventCh, &Event{Type: NodeEventTypeCreate, Node: newNode})
+	case ok && newNode == nil:
+		delete(s.keyMapNode, key)
+		send(ctx, eventCh, &Event{Type: NodeEventTypeDelete, Node: oldNode})
+	case ok && newNode != oldNode:
+		s.keyMapNode[key] = newNode
+		if !bytes.Equal(oldNode.Metadata, newNode.Metadata) {
+			send(ctx, eventCh, &Event{Type: NodeEventTypeUpdate, Node: newNode})
+		}
+	}
+}
+
+func (m *_MultiRegistry) Register(node *Node) (deregisterFunc func(), err error) {
+	deregisterFuncs := make([]func(), 0, len(m.registries))
+	deregisterFunc = func() {
+		for _, f := range deregisterFuncs {
+			f()
+		}
+	}
+	for _, registry := range m.registries {
+		f, err := registry.Register(node)
+		if err != nil {
+			deregisterFunc()
+			return nil, err
+		}
+		deregisterFuncs = append(deregisterFuncs, f)
+	}
+	return deregisterFunc, nil
+}
+
+func send(ctx context.Context, eventCh chan<- *Event, event *Event) {
+	select {
+	case eventCh <- event:
+	case <-ctx.Done():
+	}
+}
+
+func multiKey(node *Node) string {
+	return node.ServiceName + "/" + node.Addr
+}
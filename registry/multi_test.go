@@ -0,0 +1,174 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// _FakeDiscovery serves nodes and whatever events the test puts into eventCh
+	_FakeDiscovery struct {
+		nodes   []*Node
+		err     error
+		eventCh chan *Event
+		ctx     context.Context
+	}
+	// _FakeRegistry records registered nodes, Register fails with err
+	_FakeRegistry struct {
+		mutex      sync.Mutex
+		err        error
+		keyMapNode map[string]*Node
+	}
+)
+
+func newFakeDiscovery(nodes ...*Node) *_FakeDiscovery {
+	return &_FakeDiscovery{nodes: nodes, eventCh: make(chan *Event, 16)}
+}
+
+func (f *_FakeDiscovery) WatchAndGet() (<-chan *Event, map[string][]*Node, error) {
+	return f.WatchAndGetContext(context.Background())
+}
+
+func (f *_FakeDiscovery) WatchAndGetContext(ctx context.Context) (<-chan *Event, map[string][]*Node, error) {
+	f.ctx = ctx
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+	serviceNameMapNodes := make(map[string][]*Node)
+	for _, node := range f.nodes {
+		serviceNameMapNodes[node.ServiceName] = append(serviceNameMapNodes[node.ServiceName], node)
+	}
+	eventCh := make(chan *Event, 1)
+	go func() {
+		defer close(eventCh)
+		for {
+			select {
+			case event := <-f.eventCh:
+				select {
+				case eventCh <- event:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return eventCh, serviceNameMapNodes, nil
+}
+
+func (f *_FakeRegistry) Register(node *Node) (func(), error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.keyMapNode == nil {
+		f.keyMapNode = make(map[string]*Node)
+	}
+	f.keyMapNode[multiKey(node)] = node
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.keyMapNode, multiKey(node))
+	}, nil
+}
+
+func (f *_FakeRegistry) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.keyMapNode)
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan *Event) *Event {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func TestMulti(t *testing.T) {
+	first := newFakeDiscovery(&Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: []byte("first")})
+	second := newFakeDiscovery(
+		&Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080", Metadata: []byte("second")},
+		&Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"},
+	)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	eventCh, serviceNameMapNodes, err := Multi(first, second).(ContextDiscovery).WatchAndGetContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := serviceNameMapNodes["echo.Echo"]
+	if len(nodes) != 2 {
+		t.Fatalf("got %v, want the node of both discoveries deduped", nodes)
+	}
+	for _, node := range nodes {
+		if node.Addr == "10.0.0.10:8080" && string(node.Metadata) != "first" {
+			t.Fatalf("got %q, want the metadata of the first discovery", node.Metadata)
+		}
+	}
+
+	// the node is still in the second discovery, its metadata takes over
+	first.eventCh <- &Event{Type: NodeEventTypeDelete, Node: first.nodes[0]}
+	if event := receiveEvent(t, eventCh); event.Type != NodeEventTypeUpdate || string(event.Node.Metadata) != "second" {
+		t.Fatalf("got %v of %v, want update to the metadata of the second discovery", event.Type, event.Node)
+	}
+	// the same metadata from another source is not an event
+	second.eventCh <- &Event{Type: NodeEventTypeUpdate, Node: &Node{ServiceName: "echo.Echo", Addr: "10.0.0.11:8080"}}
+	second.eventCh <- &Event{Type: NodeEventTypeDelete, Node: second.nodes[0]}
+	if event := receiveEvent(t, eventCh); event.Type != NodeEventTypeDelete || event.Node.Addr != "10.0.0.10:8080" {
+		t.Fatalf("got %v of %v, want delete once no discovery has the node", event.Type, event.Node)
+	}
+	second.eventCh <- &Event{Type: NodeEventTypeCreate, Node: &Node{ServiceName: "echo.Echo", Addr: "10.0.0.12:8080"}}
+	if event := receiveEvent(t, eventCh); event.Type != NodeEventTypeCreate || event.Node.Addr != "10.0.0.12:8080" {
+		t.Fatalf("got %v of %v, want create", event.Type, event.Node)
+	}
+
+	cancelFunc()
+	for range eventCh {
+	}
+}
+
+func TestMultiWatchError(t *testing.T) {
+	first, second := newFakeDiscovery(), newFakeDiscovery()
+	second.err = errors.New("down")
+	if _, _, err := Multi(first, second).WatchAndGet(); err != second.err {
+		t.Fatalf("got %v, want %v", err, second.err)
+	}
+	select {
+	case <-first.ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("got the first discovery watching, want it stopped when another fails")
+	}
+}
+
+func TestMultiRegistry(t *testing.T) {
+	first, second := new(_FakeRegistry), new(_FakeRegistry)
+	node := &Node{ServiceName: "echo.Echo", Addr: "10.0.0.10:8080"}
+	deregisterFunc, err := MultiRegistry(first, second).Register(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.count() != 1 || second.count() != 1 {
+		t.Fatalf("got %v and %v nodes, want the node in both registries", first.count(), second.count())
+	}
+	deregisterFunc()
+	if first.count() != 0 || second.count() != 0 {
+		t.Fatalf("got %v and %v nodes, want the node deregistered from both", first.count(), second.count())
+	}
+
+	second.err = errors.New("down")
+	if _, err := MultiRegistry(first, second).Register(node); err != second.err {
+		t.Fatalf("got %v, want %v", err, second.err)
+	}
+	if first.count() != 0 {
+		t.Fatalf("got %v nodes, want the node deregistered from the first registry when the second fails", first.count())
+	}
+}
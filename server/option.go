@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/go-productive/micro/registry"
 	"google.golang.org/grpc"
 	"log"
 	"time"
@@ -9,7 +10,7 @@ import (
 type (
 	_Options struct {
 		serverOptions         []grpc.ServerOption
-		metadata              []byte
+		metadata              registry.Metadata
 		shutdownSleepDuration time.Duration
 		logInfoFunc           func(msg string, keysAndValues ...interface{})
 	}
@@ -35,9 +36,52 @@ func WithServerOptions(opts ...grpc.ServerOption) Option {
 	}
 }
 
+// WithMetadata sets opaque metadata, it is registered as is for older clients, unless structured metadata
+// like WithVersion or WithZone is set too, then it is encoded along with it and read back from Metadata.Raw
 func WithMetadata(metadata []byte) Option {
 	return func(o *_Options) {
-		o.metadata = metadata
+		o.metadata.Raw = metadata
+	}
+}
+
+func WithVersion(version string) Option {
+	return func(o *_Options) {
+		o.metadata.Version = version
+	}
+}
+
+func WithZone(zone string) Option {
+	return func(o *_Options) {
+		o.metadata.Zone = zone
+	}
+}
+
+func WithRegion(region string) Option {
+	return func(o *_Options) {
+		o.metadata.Region = region
+	}
+}
+
+func WithWeight(weight int) Option {
+	return func(o *_Options) {
+		o.metadata.Weight = weight
+	}
+}
+
+func WithTags(tags ...string) Option {
+	return func(o *_Options) {
+		o.metadata.Tags = append(o.metadata.Tags, tags...)
+	}
+}
+
+func WithLabels(labels map[string]string) Option {
+	return func(o *_Options) {
+		if o.metadata.Labels == nil {
+			o.metadata.Labels = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			o.metadata.Labels[k] = v
+		}
 	}
 }
 
@@ -81,12 +81,19 @@ func (g *GRPCServer) register() (err error) {
 			g.deregister()
 		}
 	}()
+	metadata := g.options.metadata
+	if len(metadata.Raw) > 0 && !metadata.IsRaw() {
+		g.options.logInfoFunc("Register", "warning", "WithMetadata is encoded along with structured metadata, older clients no longer read it as is")
+	}
+	if !metadata.IsRaw() { // raw only metadata stays raw for older clients
+		metadata.StartTime = time.Now()
+	}
 	g.serviceNameMapNode = make(map[string]*registry.Node, len(g.server.GetServiceInfo()))
 	for serviceName := range g.server.GetServiceInfo() {
 		node := &registry.Node{
 			ServiceName: serviceName,
 			Addr:        g.addr,
-			Metadata:    g.options.metadata,
+			Metadata:    registry.EncodeMetadata(&metadata),
 		}
 		deregisterFunc, err := g.registry.Register(node)
 		if err != nil {